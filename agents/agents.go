@@ -17,19 +17,15 @@
 package agents
 
 import (
-	"archive/tar"
-	"compress/gzip"
 	"context"
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/racker/telemetry-envoy/config"
 	"github.com/racker/telemetry-envoy/telemetry_edge"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"io"
 	"io/ioutil"
-	"net/http"
 	"os"
-	"path"
 )
 
 const (
@@ -39,6 +35,9 @@ const (
 	binSubpath        = "bin"
 	dirPerms          = 0755
 	configFilePerms   = 0600
+	// stagingPrefix is used for the temporary directories where agent packages are downloaded
+	// and extracted prior to being moved into their final location
+	stagingPrefix = ".staging-"
 )
 
 // SpecificAgentRunner manages the lifecyle and configuration of a single type of agent
@@ -52,17 +51,25 @@ type SpecificAgentRunner interface {
 	// It must ensure the agent process is running if configs and executable are available
 	// It must also ensure that that the process is stopped if no configuration remains
 	EnsureRunningState(ctx context.Context, applyConfigs bool)
-	ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) error
+	// ProcessConfig applies each of the configuration operations and returns an acknowledgement
+	// for each, in order. An error is returned when none of the operations could be applied.
+	ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) ([]*telemetry_edge.ConfigurationOpAck, error)
 	// Stop should stop the agent's process, if running
 	Stop()
+	// IsRunning indicates if the agent's process is currently running
+	IsRunning() bool
 }
 
 // Router routes external agent operations to the respective SpecificAgentRunner instance
 type Router interface {
 	// Start ensures that when the ctx is done, then the managed SpecificAgentRunner instances will be stopped
 	Start(ctx context.Context)
-	ProcessInstall(install *telemetry_edge.EnvoyInstructionInstall)
-	ProcessConfigure(configure *telemetry_edge.EnvoyInstructionConfigure)
+	ProcessInstall(install *telemetry_edge.EnvoyInstructionInstall) *telemetry_edge.InstallAck
+	ProcessConfigure(configure *telemetry_edge.EnvoyInstructionConfigure) *telemetry_edge.ConfigureAck
+	ProcessRollback(rollback *telemetry_edge.EnvoyInstructionRollback)
+	// ProcessRefresh converges the agents to the desired state of the refresh and returns the acks
+	// of the instructions that were applied to do so
+	ProcessRefresh(refresh *telemetry_edge.EnvoyInstructionRefresh) []*telemetry_edge.InstructionAck
 }
 
 type noAppliedConfigsError struct{}
@@ -80,64 +87,59 @@ func IsNoAppliedConfigs(err error) bool {
 	return ok
 }
 
-func init() {
-	viper.SetDefault(config.AgentsDataPath, config.DefaultAgentsDataPath)
+type checksumMismatchError struct {
+	checksumType telemetry_edge.Checksum_Type
+	expected     string
+	actual       string
 }
 
-func downloadExtractTarGz(outputPath, url string, exePath string) error {
-
-	log.WithField("file", url).Debug("downloading agent")
-	resp, err := http.Get(url)
-	if err != nil {
-		return errors.Wrap(err, "failed to download agent")
-	}
-	//noinspection GoUnhandledErrorResult
-	defer resp.Body.Close()
-
-	gzipReader, err := gzip.NewReader(resp.Body)
-	if err != nil {
-		return errors.Wrap(err, "unable to ungzip agent download")
-	}
+func (e *checksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, but downloaded content has %s",
+		e.checksumType, e.expected, e.actual)
+}
 
-	_, exeFilename := path.Split(exePath)
-	binOutPath := path.Join(outputPath, binSubpath)
-	err = os.Mkdir(binOutPath, dirPerms)
-	if err != nil {
-		return errors.Wrap(err, "unable to create bin directory")
+// IsChecksumMismatch tests if an error indicates that a downloaded agent package did not match
+// the checksum given in the install instruction
+func IsChecksumMismatch(err error) bool {
+	if err == nil {
+		return false
 	}
+	_, ok := errors.Cause(err).(*checksumMismatchError)
+	return ok
+}
 
-	processedExe := false
-	tarReader := tar.NewReader(gzipReader)
-	for {
-		header, err := tarReader.Next()
-		if err == io.EOF {
-			break
-		}
-
-		if header.Name == exePath {
+type downloadError struct {
+	url        string
+	attempts   int
+	statusCode int
+	err        error
+}
 
-			file, err := os.OpenFile(path.Join(binOutPath, exeFilename), os.O_RDWR|os.O_CREATE, os.FileMode(header.Mode))
-			if err != nil {
-				log.WithError(err).Error("unable to open file for writing")
-				continue
-			}
+func (e *downloadError) Error() string {
+	return fmt.Sprintf("failed to download %s after %d attempt(s): %v", e.url, e.attempts, e.err)
+}
 
-			_, err = io.Copy(file, tarReader)
-			if err != nil {
-				_ = file.Close()
-				log.WithError(err).Error("unable to write to file")
-				continue
-			} else {
-				processedExe = true
-			}
-		}
+// IsDownloadError tests if an error indicates that an agent package could not be downloaded,
+// such as due to an HTTP error status or exhausting the download retries
+func IsDownloadError(err error) bool {
+	if err == nil {
+		return false
 	}
+	_, ok := errors.Cause(err).(*downloadError)
+	return ok
+}
 
-	if !processedExe {
-		return errors.New("failed to find/process agent executable")
+// DownloadStatusCode returns the HTTP status code that caused an agent download to fail or zero if
+// the failure was not due to an HTTP status
+func DownloadStatusCode(err error) int {
+	if downloadErr, ok := errors.Cause(err).(*downloadError); ok {
+		return downloadErr.statusCode
 	}
+	return 0
+}
 
-	return nil
+func init() {
+	viper.SetDefault(config.AgentsDataPath, config.DefaultAgentsDataPath)
 }
 
 func fileExists(file string) bool {
@@ -153,8 +155,8 @@ func fileExists(file string) bool {
 
 // handleContentConfigurationOp handles agent config operations that work with content simply written to
 // the file named by configInstancePath
-// Returns true if the configuration was applied
-func handleContentConfigurationOp(op *telemetry_edge.ConfigurationOp, configInstancePath string, conversion Conversion) bool {
+// Returns an error describing why the configuration could not be applied
+func handleContentConfigurationOp(op *telemetry_edge.ConfigurationOp, configInstancePath string, conversion Conversion) error {
 	switch op.GetType() {
 	case telemetry_edge.ConfigurationOp_CREATE, telemetry_edge.ConfigurationOp_MODIFY:
 
@@ -168,30 +170,43 @@ func handleContentConfigurationOp(op *telemetry_edge.ConfigurationOp, configInst
 			finalConfig, err = ConvertJsonToTelegrafToml(op.GetContent(), op.ExtraLabels)
 			if err != nil {
 				log.WithError(err).WithField("op", op).Warn("failed to convert config blob to TOML")
-				return false
+				return errors.Wrap(err, "failed to convert config blob to TOML")
 			}
 		}
 
 		err = ioutil.WriteFile(configInstancePath, finalConfig, configFilePerms)
 		if err != nil {
 			log.WithError(err).WithField("op", op).Warn("failed to process telegraf config operation")
-		} else {
-			return true
+			return errors.Wrap(err, "failed to write config file")
 		}
+		return nil
 
 	case telemetry_edge.ConfigurationOp_REMOVE:
 		err := os.Remove(configInstancePath)
 		if err != nil {
 			if os.IsNotExist(err) {
 				log.WithField("op", op).Warn("did not need to remove since already removed")
-				return true
-			} else {
-				log.WithError(err).WithField("op", op).Warn("failed to remove config instance file")
+				return nil
 			}
-		} else {
-			return true
+			log.WithError(err).WithField("op", op).Warn("failed to remove config instance file")
+			return errors.Wrap(err, "failed to remove config file")
 		}
+		return nil
 	}
 
-	return false
+	return errors.Errorf("unsupported operation type: %v", op.GetType())
+}
+
+// newConfigurationOpAck reports the outcome of applying a configuration operation, where
+// err is nil when the operation was applied
+func newConfigurationOpAck(op *telemetry_edge.ConfigurationOp, err error) *telemetry_edge.ConfigurationOpAck {
+	ack := &telemetry_edge.ConfigurationOpAck{
+		Id:       op.GetId(),
+		Revision: op.GetRevision(),
+		Success:  err == nil,
+	}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	return ack
 }
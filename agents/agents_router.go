@@ -26,26 +26,39 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
+func init() {
+	viper.SetDefault(config.AgentsUpgradeGracePeriod, 10*time.Second)
+}
+
+// StandardAgentsRouter serializes the processing of instructions, along with reverting failed
+// upgrades, since each of them changes the installed versions, configs, and running agents.
 type StandardAgentsRouter struct {
+	sync.Mutex
 	DataPath string
 
-	ctx context.Context
+	ctx            context.Context
+	commandHandler CommandHandler
+	appliedConfigs map[telemetry_edge.AgentType]*appliedConfigs
 }
 
 func NewAgentsRunner() (Router, error) {
 	ar := &StandardAgentsRouter{
-		DataPath: viper.GetString(config.AgentsDataPath),
+		DataPath:       viper.GetString(config.AgentsDataPath),
+		appliedConfigs: make(map[telemetry_edge.AgentType]*appliedConfigs),
 	}
 
 	commandHandler := NewCommandHandler()
-
-	ar.PurgeAgentConfigs()
+	ar.commandHandler = commandHandler
 
 	for agentType, runner := range specificAgentRunners {
 
 		agentBasePath := filepath.Join(ar.DataPath, agentsSubpath, agentType.String())
+		ar.restoreAppliedConfigs(agentType, agentBasePath)
+		repairAgentInstalls(agentBasePath)
 
 		runner.SetCommandHandler(commandHandler)
 		err := runner.Load(agentBasePath)
@@ -58,29 +71,63 @@ func NewAgentsRunner() (Router, error) {
 }
 
 func (ar *StandardAgentsRouter) Start(ctx context.Context) {
+	ar.Lock()
 	ar.ctx = ctx
 
+	// resume the agents with the configs that were retained from before
+	for _, specific := range specificAgentRunners {
+		specific.EnsureRunningState(ctx, false)
+	}
+	ar.Unlock()
+
 	for {
 		select {
-		case <-ar.ctx.Done():
+		case <-ctx.Done():
 			log.Debug("stopping specific runners")
+			ar.Lock()
 			for _, specific := range specificAgentRunners {
 				specific.Stop()
 			}
+			ar.Unlock()
 			return
 		}
 	}
 }
 
-func (ar *StandardAgentsRouter) ProcessInstall(install *telemetry_edge.EnvoyInstructionInstall) {
+func (ar *StandardAgentsRouter) ProcessInstall(install *telemetry_edge.EnvoyInstructionInstall) *telemetry_edge.InstallAck {
+	ar.Lock()
+	defer ar.Unlock()
+
+	return ar.installAck(install)
+}
+
+// installAck processes the install instruction and acknowledges its outcome
+func (ar *StandardAgentsRouter) installAck(install *telemetry_edge.EnvoyInstructionInstall) *telemetry_edge.InstallAck {
 	log.WithField("install", install).Info("processing install instruction")
 
+	ack := &telemetry_edge.InstallAck{
+		Agent:   install.GetAgent(),
+		Success: true,
+	}
+	err := ar.processInstall(install)
+	if err != nil {
+		ack.Success = false
+		ack.Error = err.Error()
+	}
+	return ack
+}
+
+// processInstall installs or switches to the agent version of the install instruction and returns
+// an error describing why that failed
+func (ar *StandardAgentsRouter) processInstall(install *telemetry_edge.EnvoyInstructionInstall) error {
 	agentType := install.Agent.Type
 	if _, exists := specificAgentRunners[agentType]; !exists {
 		log.WithField("type", agentType).Warn("no specific runner for agent type")
-		return
+		return errors.Errorf("no specific runner for agent type %s", agentType)
 	}
 
+	ar.resetRestarts(agentType)
+
 	agentVersion := install.Agent.Version
 	agentBasePath := path.Join(ar.DataPath, agentsSubpath, agentType.String())
 	outputPath := path.Join(agentBasePath, agentVersion)
@@ -89,45 +136,84 @@ func (ar *StandardAgentsRouter) ProcessInstall(install *telemetry_edge.EnvoyInst
 	if err != nil {
 		abs = outputPath
 	}
+	previousVersion := currentVersion(agentBasePath)
 	if !fileExists(outputPath) {
-		err := os.MkdirAll(outputPath, dirPerms)
+		err = installAgentPackage(agentBasePath, install)
 		if err != nil {
-			log.WithError(err).WithField("path", outputPath).Error("unable to mkdirs")
-			return
+			if IsChecksumMismatch(err) {
+				log.WithError(err).WithFields(log.Fields{
+					"url":     install.Url,
+					"type":    agentType,
+					"version": agentVersion,
+				}).Error("rejected agent install since download did not match checksum")
+			} else if IsDownloadError(err) {
+				log.WithError(err).WithFields(log.Fields{
+					"url":        install.Url,
+					"type":       agentType,
+					"version":    agentVersion,
+					"statusCode": DownloadStatusCode(err),
+				}).Error("failed to download agent")
+			} else {
+				log.WithError(err).Error("failed to download and extract agent")
+			}
+			postInstallFailedEvent(install.GetAgent(), err.Error())
+			return err
 		}
 
-		err = downloadExtractTarGz(outputPath, install.Url, install.Exe)
+		// NOTE rather than symlink, might later use a metadata file
+		err = switchCurrentVersion(agentBasePath, agentVersion)
 		if err != nil {
 			os.RemoveAll(outputPath)
-			log.WithError(err).Error("failed to download and extract agent")
-			return
+			log.WithError(err).WithFields(log.Fields{
+				"version": agentVersion,
+				"type":    agentType,
+			}).Error("failed to switch current version symlink")
+			postInstallFailedEvent(install.GetAgent(), err.Error())
+			return err
 		}
 
-		// NOTE rather than symlink, might later use a metadata file
-		currentSymlinkPath := path.Join(agentBasePath, currentVerLink)
-		err = os.Remove(currentSymlinkPath)
-		if err != nil && !os.IsNotExist(err) {
-			os.RemoveAll(outputPath)
-			log.WithError(err).Warn("failed to delete current version symlink")
-			return
+		err = ar.startCurrentVersion(agentType, agentBasePath, previousVersion, agentVersion)
+		if err != nil {
+			return err
 		}
-		err = os.Symlink(agentVersion, currentSymlinkPath)
+
+		log.WithFields(log.Fields{
+			"path":    abs,
+			"type":    agentType,
+			"version": agentVersion,
+		}).Info("installed agent")
+		postAgentEvent(&telemetry_edge.AgentEvent{
+			Agent: install.GetAgent(),
+			Type:  telemetry_edge.AgentEvent_INSTALLED,
+		})
+
+		pruneAgentVersions(agentBasePath, viper.GetInt(config.AgentsRetainVersions))
+	} else if previousVersion != agentVersion {
+		// a previously installed version was retained, so just switch back to it
+		err = switchCurrentVersion(agentBasePath, agentVersion)
 		if err != nil {
-			os.RemoveAll(outputPath)
 			log.WithError(err).WithFields(log.Fields{
 				"version": agentVersion,
 				"type":    agentType,
-			}).Error("failed to create current version symlink")
-			return
+			}).Error("failed to switch current version symlink")
+			postInstallFailedEvent(install.GetAgent(), err.Error())
+			return err
 		}
 
-		specificAgentRunners[agentType].EnsureRunningState(ar.ctx, false)
+		err = ar.startCurrentVersion(agentType, agentBasePath, previousVersion, agentVersion)
+		if err != nil {
+			return err
+		}
 
 		log.WithFields(log.Fields{
 			"path":    abs,
 			"type":    agentType,
 			"version": agentVersion,
-		}).Info("installed agent")
+		}).Info("switched to previously installed agent")
+		postAgentEvent(&telemetry_edge.AgentEvent{
+			Agent: install.GetAgent(),
+			Type:  telemetry_edge.AgentEvent_INSTALLED,
+		})
 	} else {
 		log.WithFields(log.Fields{
 			"type":    agentType,
@@ -138,15 +224,161 @@ func (ar *StandardAgentsRouter) ProcessInstall(install *telemetry_edge.EnvoyInst
 		specificAgentRunners[agentType].EnsureRunningState(ar.ctx, false)
 
 	}
+
+	return nil
+}
+
+// startCurrentVersion gets the agent running with the version that was just made current. An agent
+// that was running the previous version is restarted and, if it exits within the upgrade grace
+// period, the previous version is restored. Returns an error if the upgraded agent failed to start
+// and was reverted right away.
+func (ar *StandardAgentsRouter) startCurrentVersion(agentType telemetry_edge.AgentType, agentBasePath string,
+	previousVersion string, agentVersion string) error {
+
+	specificRunner := specificAgentRunners[agentType]
+	if previousVersion == "" || !specificRunner.IsRunning() {
+		ar.commandHandler.WatchUpgrade(agentType, 0, nil)
+		specificRunner.EnsureRunningState(ar.ctx, false)
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"type":    agentType,
+		"from":    previousVersion,
+		"version": agentVersion,
+	}).Info("restarting agent with new version")
+	// the watch is in place before the restart, since the agent could exit right away
+	ar.commandHandler.WatchUpgrade(agentType, viper.GetDuration(config.AgentsUpgradeGracePeriod), func() {
+		ar.Lock()
+		defer ar.Unlock()
+		ar.revertUpgrade(agentType, agentBasePath, previousVersion, agentVersion)
+	})
+	ar.restartAgent(specificRunner)
+
+	if !specificRunner.IsRunning() {
+		ar.commandHandler.WatchUpgrade(agentType, 0, nil)
+		return ar.revertUpgrade(agentType, agentBasePath, previousVersion, agentVersion)
+	}
+	return nil
+}
+
+// revertUpgrade restores the previous version of an agent that did not stay running after it was
+// upgraded and returns an error describing the failed upgrade. The router needs to be locked.
+func (ar *StandardAgentsRouter) revertUpgrade(agentType telemetry_edge.AgentType, agentBasePath string,
+	previousVersion string, agentVersion string) error {
+
+	if currentVersion(agentBasePath) != agentVersion {
+		// a later instruction already moved on from the upgraded version
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"type":     agentType,
+		"version":  agentVersion,
+		"previous": previousVersion,
+	}).Error("agent did not stay running after upgrade, reverting to previous version")
+	failure := errors.Errorf("agent did not stay running, reverted to version %s", previousVersion)
+	postInstallFailedEvent(&telemetry_edge.Agent{Type: agentType, Version: agentVersion}, failure.Error())
+
+	err := switchCurrentVersion(agentBasePath, previousVersion)
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"version": previousVersion,
+			"type":    agentType,
+		}).Error("failed to revert current version symlink")
+		return errors.Wrap(err, "agent did not stay running and failed to revert to previous version")
+	}
+
+	// remove the failed version so that it's not used again without a fresh install
+	failedPath := path.Join(agentBasePath, agentVersion)
+	err = os.RemoveAll(failedPath)
+	if err != nil {
+		log.WithError(err).WithField("path", failedPath).Warn("failed to remove failed agent version")
+	}
+
+	ar.restartAgent(specificAgentRunners[agentType])
+	return failure
+}
+
+func postInstallFailedEvent(agent *telemetry_edge.Agent, message string) {
+	postAgentEvent(&telemetry_edge.AgentEvent{
+		Agent:   agent,
+		Type:    telemetry_edge.AgentEvent_INSTALL_FAILED,
+		Message: message,
+	})
+}
+
+func (ar *StandardAgentsRouter) ProcessRollback(rollback *telemetry_edge.EnvoyInstructionRollback) {
+	ar.Lock()
+	defer ar.Unlock()
+
+	log.WithField("instruction", rollback).Info("processing rollback instruction")
+
+	agentType := rollback.GetAgent().GetType()
+	specificRunner, exists := specificAgentRunners[agentType]
+	if !exists {
+		log.WithField("type", agentType).Warn("no specific runner for agent type")
+		return
+	}
+
+	agentBasePath := path.Join(ar.DataPath, agentsSubpath, agentType.String())
+	previousVersion := currentVersion(agentBasePath)
+
+	agentVersion, err := rollbackAgentVersion(agentBasePath, rollback.GetAgent().GetVersion())
+	if err != nil {
+		log.WithError(err).WithField("type", agentType).Error("failed to roll back agent")
+		return
+	}
+	if agentVersion == previousVersion {
+		log.WithFields(log.Fields{
+			"type":    agentType,
+			"version": agentVersion,
+		}).Info("agent is already at rollback version")
+		return
+	}
+
+	ar.commandHandler.WatchUpgrade(agentType, 0, nil)
+	ar.restartAgent(specificRunner)
+
+	log.WithFields(log.Fields{
+		"type":    agentType,
+		"from":    previousVersion,
+		"version": agentVersion,
+	}).Info("rolled back agent")
+}
+
+// restartAgent stops the agent so that it starts again from the current version
+func (ar *StandardAgentsRouter) restartAgent(specificRunner SpecificAgentRunner) {
+	specificRunner.Stop()
+	specificRunner.EnsureRunningState(ar.ctx, false)
 }
 
-func (ar *StandardAgentsRouter) ProcessConfigure(configure *telemetry_edge.EnvoyInstructionConfigure) {
+func (ar *StandardAgentsRouter) ProcessConfigure(configure *telemetry_edge.EnvoyInstructionConfigure) *telemetry_edge.ConfigureAck {
+	ar.Lock()
+	defer ar.Unlock()
+
+	return ar.processConfigure(configure)
+}
+
+func (ar *StandardAgentsRouter) processConfigure(configure *telemetry_edge.EnvoyInstructionConfigure) *telemetry_edge.ConfigureAck {
 	log.WithField("instruction", configure).Info("processing configure instruction")
 
 	agentType := configure.GetAgentType()
+	ack := &telemetry_edge.ConfigureAck{
+		AgentType: agentType,
+	}
 	if specificRunner, exists := specificAgentRunners[agentType]; exists {
+		ar.resetRestarts(agentType)
 
-		err := specificRunner.ProcessConfig(configure)
+		state := ar.appliedConfigsOf(agentType)
+		current, staleAcks := filterStaleConfigurationOps(configure, state)
+		if len(current.GetOperations()) == 0 {
+			log.Warn("no configuration was applied since all operations were stale")
+			ack.Operations = orderConfigurationOpAcks(configure, nil, staleAcks)
+			return ack
+		}
+
+		opAcks, err := specificRunner.ProcessConfig(current)
 		if err != nil {
 			if IsNoAppliedConfigs(err) {
 				log.Warn("no configuration was applied")
@@ -156,18 +388,167 @@ func (ar *StandardAgentsRouter) ProcessConfigure(configure *telemetry_edge.Envoy
 		} else {
 			specificRunner.EnsureRunningState(ar.ctx, true)
 		}
+
+		if opAcks == nil {
+			opAcks = failedConfigurationOpAcks(current, err)
+		}
+		ar.recordAppliedConfigs(state, current, opAcks)
+		ack.Operations = orderConfigurationOpAcks(configure, opAcks, staleAcks)
 	} else {
 		log.WithField("type", configure.GetAgentType()).Warn("unable to configure unknown agent type")
+		ack.Operations = failedConfigurationOpAcks(configure,
+			errors.Errorf("unable to configure unknown agent type %s", agentType))
+	}
+
+	return ack
+}
+
+// filterStaleConfigurationOps splits off the operations that have a lower revision than the one
+// already applied. Those are acknowledged as failed since they were not applied, and their acks
+// are keyed by the index of the operation in the instruction.
+func filterStaleConfigurationOps(configure *telemetry_edge.EnvoyInstructionConfigure,
+	state *appliedConfigs) (*telemetry_edge.EnvoyInstructionConfigure, map[int]*telemetry_edge.ConfigurationOpAck) {
+
+	current := &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: configure.GetAgentType(),
 	}
+	staleAcks := make(map[int]*telemetry_edge.ConfigurationOpAck)
+	for i, op := range configure.GetOperations() {
+		if stale, appliedRevision := state.isStale(op); stale {
+			log.WithFields(log.Fields{
+				"op":              op,
+				"appliedRevision": appliedRevision,
+			}).Warn("ignoring stale configuration operation")
+			staleAcks[i] = newConfigurationOpAck(op,
+				errors.Errorf("ignored stale revision %s since revision %s was already applied",
+					op.GetRevision(), appliedRevision))
+			continue
+		}
+		current.Operations = append(current.Operations, op)
+	}
+
+	return current, staleAcks
 }
 
+// orderConfigurationOpAcks combines the acks of the operations that were processed, in order,
+// with the acks of the stale operations such that they're in the order of the instruction's
+// operations
+func orderConfigurationOpAcks(configure *telemetry_edge.EnvoyInstructionConfigure,
+	opAcks []*telemetry_edge.ConfigurationOpAck,
+	staleAcks map[int]*telemetry_edge.ConfigurationOpAck) []*telemetry_edge.ConfigurationOpAck {
+
+	acks := make([]*telemetry_edge.ConfigurationOpAck, 0, len(configure.GetOperations()))
+	next := 0
+	for i, op := range configure.GetOperations() {
+		if staleAck, stale := staleAcks[i]; stale {
+			acks = append(acks, staleAck)
+			continue
+		}
+		if next < len(opAcks) {
+			acks = append(acks, opAcks[next])
+		} else {
+			acks = append(acks, newConfigurationOpAck(op, errors.New("operation was not acknowledged by the agent runner")))
+		}
+		next++
+	}
+	return acks
+}
+
+// recordAppliedConfigs persists the revisions of the operations that were successfully applied
+func (ar *StandardAgentsRouter) recordAppliedConfigs(state *appliedConfigs,
+	configure *telemetry_edge.EnvoyInstructionConfigure, opAcks []*telemetry_edge.ConfigurationOpAck) {
+
+	changed := false
+	for i, op := range configure.GetOperations() {
+		if i < len(opAcks) && opAcks[i].GetSuccess() {
+			state.record(op)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+
+	err := state.save()
+	if err != nil {
+		log.WithError(err).WithField("type", configure.GetAgentType()).
+			Warn("failed to persist applied configs state")
+	}
+}
+
+// appliedConfigsOf returns the applied configuration state of the given agent type
+func (ar *StandardAgentsRouter) appliedConfigsOf(agentType telemetry_edge.AgentType) *appliedConfigs {
+	state, exists := ar.appliedConfigs[agentType]
+	if !exists {
+		agentBasePath := path.Join(ar.DataPath, agentsSubpath, agentType.String())
+		state, _, _ = loadAppliedConfigs(agentBasePath)
+		ar.appliedConfigs[agentType] = state
+	}
+	return state
+}
+
+// restoreAppliedConfigs retains the configs of an agent that were recorded as applied prior to
+// the last shutdown. Without recorded state, the configs are purged since they can't be trusted.
+func (ar *StandardAgentsRouter) restoreAppliedConfigs(agentType telemetry_edge.AgentType, agentBasePath string) {
+	configsPath := path.Join(agentBasePath, configsDirSubpath)
+
+	state, exists, err := loadAppliedConfigs(agentBasePath)
+	if err != nil {
+		log.WithError(err).WithField("type", agentType).Warn("discarding unusable applied configs state")
+	}
+	ar.appliedConfigs[agentType] = state
+
+	if exists {
+		log.WithFields(log.Fields{
+			"type": agentType,
+			"ops":  len(state.Ops),
+		}).Info("retaining previously applied agent configs")
+		state.removeUnknownConfigs(configsPath)
+	} else {
+		purgeAgentConfigs(configsPath)
+	}
+}
+
+// failedConfigurationOpAcks acknowledges each of the operations as failed when the configure
+// instruction could not be processed as a whole
+func failedConfigurationOpAcks(configure *telemetry_edge.EnvoyInstructionConfigure, err error) []*telemetry_edge.ConfigurationOpAck {
+	acks := make([]*telemetry_edge.ConfigurationOpAck, 0, len(configure.GetOperations()))
+	for _, op := range configure.GetOperations() {
+		acks = append(acks, newConfigurationOpAck(op, err))
+	}
+	return acks
+}
+
+// resetRestarts gives an agent a fresh start since a new instruction might resolve its failures
+func (ar *StandardAgentsRouter) resetRestarts(agentType telemetry_edge.AgentType) {
+	if ar.commandHandler.IsCrashLooping(agentType) {
+		log.WithField("type", agentType).Info("clearing crash looping state of agent")
+	}
+	ar.commandHandler.ResetRestarts(agentType)
+}
+
+// PurgeAgentConfigs removes the configs of all agents along with their applied configuration state
 func (ar *StandardAgentsRouter) PurgeAgentConfigs() {
+	ar.Lock()
+	defer ar.Unlock()
+
 	for agentType := range specificAgentRunners {
-		configsPath := path.Join(ar.DataPath, agentsSubpath, agentType.String(), configsDirSubpath)
-		log.WithField("path", configsPath).Debug("purging agent config directory")
-		err := os.RemoveAll(configsPath)
+		agentBasePath := path.Join(ar.DataPath, agentsSubpath, agentType.String())
+		purgeAgentConfigs(path.Join(agentBasePath, configsDirSubpath))
+
+		state := ar.appliedConfigsOf(agentType)
+		state.Ops = make(map[string]*appliedConfig)
+		err := state.save()
 		if err != nil {
-			log.WithError(err).WithField("path", configsPath).Warn("failed to purge configs directory")
+			log.WithError(err).WithField("type", agentType).Warn("failed to reset applied configs state")
 		}
 	}
 }
+
+func purgeAgentConfigs(configsPath string) {
+	log.WithField("path", configsPath).Debug("purging agent config directory")
+	err := os.RemoveAll(configsPath)
+	if err != nil {
+		log.WithError(err).WithField("path", configsPath).Warn("failed to purge configs directory")
+	}
+}
@@ -17,7 +17,11 @@
 package agents_test
 
 import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
 	"github.com/petergtz/pegomock"
+	"github.com/pkg/errors"
 	"github.com/racker/telemetry-envoy/agents"
 	"github.com/racker/telemetry-envoy/agents/matchers"
 	"github.com/racker/telemetry-envoy/config"
@@ -30,6 +34,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -85,6 +90,10 @@ func TestAgentsRunner_ProcessInstall(t *testing.T) {
 					Version: tt.version,
 					Type:    tt.agentType,
 				},
+				Checksum: &telemetry_edge.Checksum{
+					Type:  telemetry_edge.Checksum_SHA256,
+					Value: sha256File(t, path.Join("testdata", tt.file)),
+				},
 			}
 
 			agentsRunner.ProcessInstall(install)
@@ -96,3 +105,230 @@ func TestAgentsRunner_ProcessInstall(t *testing.T) {
 		})
 	}
 }
+
+func TestAgentsRunner_ProcessInstall_Checksums(t *testing.T) {
+	content, err := ioutil.ReadFile(path.Join("testdata", "telegraf_dot_slash.tgz"))
+	require.NoError(t, err)
+	sha512Sum := sha512.Sum512(content)
+
+	var tests = []struct {
+		name      string
+		checksum  *telemetry_edge.Checksum
+		installed bool
+	}{
+		{
+			name: "sha512",
+			checksum: &telemetry_edge.Checksum{
+				Type:  telemetry_edge.Checksum_SHA512,
+				Value: hex.EncodeToString(sha512Sum[:]),
+			},
+			installed: true,
+		},
+		{
+			name: "mismatch",
+			checksum: &telemetry_edge.Checksum{
+				Type:  telemetry_edge.Checksum_SHA256,
+				Value: hex.EncodeToString(make([]byte, sha256.Size)),
+			},
+			installed: false,
+		},
+		{
+			name: "wrongType",
+			checksum: &telemetry_edge.Checksum{
+				Type:  telemetry_edge.Checksum_SHA256,
+				Value: hex.EncodeToString(sha512Sum[:]),
+			},
+			installed: false,
+		},
+		{
+			name:      "missing",
+			checksum:  nil,
+			installed: false,
+		},
+	}
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pegomock.RegisterMockTestingT(t)
+
+			agents.UnregisterAllAgentRunners()
+
+			dataPath, err := ioutil.TempDir("", "test_agents")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataPath)
+			viper.Set(config.AgentsDataPath, dataPath)
+
+			agentsRunner, err := agents.NewAgentsRunner()
+			require.NoError(t, err)
+
+			mockSpecificAgentRunner := NewMockSpecificAgentRunner()
+			agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, mockSpecificAgentRunner)
+
+			install := &telemetry_edge.EnvoyInstructionInstall{
+				Url: ts.URL + "/telegraf_dot_slash.tgz",
+				Exe: "./telegraf/usr/bin/telegraf",
+				Agent: &telemetry_edge.Agent{
+					Version: "1.8.0",
+					Type:    telemetry_edge.AgentType_TELEGRAF,
+				},
+				Checksum: tt.checksum,
+			}
+
+			agentsRunner.ProcessInstall(install)
+
+			versionPath := path.Join(dataPath, "agents", "TELEGRAF", "1.8.0")
+			if tt.installed {
+				mockSpecificAgentRunner.VerifyWasCalledOnce().
+					EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+				assert.FileExists(t, path.Join(versionPath, "bin", "telegraf"))
+			} else {
+				mockSpecificAgentRunner.VerifyWasCalled(pegomock.Never()).
+					EnsureRunningState(matchers.AnyContextContext(), pegomock.AnyBool())
+				_, err = os.Stat(versionPath)
+				assert.True(t, os.IsNotExist(err), "version directory should not exist")
+			}
+
+			// staging content should never be left behind
+			entries, err := ioutil.ReadDir(path.Join(dataPath, "agents", "TELEGRAF"))
+			require.NoError(t, err)
+			for _, entry := range entries {
+				assert.False(t, strings.HasPrefix(entry.Name(), ".staging-"), "found %s", entry.Name())
+			}
+		})
+	}
+}
+
+func TestAgentsRunner_ProcessInstall_ReplacesCurrent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+
+	agents.UnregisterAllAgentRunners()
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	agentsRunner, err := agents.NewAgentsRunner()
+	require.NoError(t, err)
+
+	mockSpecificAgentRunner := NewMockSpecificAgentRunner()
+	agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, mockSpecificAgentRunner)
+
+	for _, version := range []string{"1.8.0", "1.9.0"} {
+		agentsRunner.ProcessInstall(&telemetry_edge.EnvoyInstructionInstall{
+			Url: ts.URL + "/telegraf_dot_slash.tgz",
+			Exe: "./telegraf/usr/bin/telegraf",
+			Agent: &telemetry_edge.Agent{
+				Version: version,
+				Type:    telemetry_edge.AgentType_TELEGRAF,
+			},
+			Checksum: &telemetry_edge.Checksum{
+				Type:  telemetry_edge.Checksum_SHA256,
+				Value: sha256File(t, path.Join("testdata", "telegraf_dot_slash.tgz")),
+			},
+		})
+
+		target, err := os.Readlink(path.Join(dataPath, "agents", "TELEGRAF", "CURRENT"))
+		require.NoError(t, err)
+		assert.Equal(t, version, target)
+	}
+}
+
+func TestNewAgentsRunner_RepairsInterruptedInstalls(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	agents.UnregisterAllAgentRunners()
+	agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, NewMockSpecificAgentRunner())
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	agentBasePath := path.Join(dataPath, "agents", "TELEGRAF")
+	// a complete install
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, "1.7.0", "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(agentBasePath, "1.7.0", "bin", "telegraf"), []byte("exe"), 0755))
+	// a complete install that was fully extracted
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, "1.7.1", "bin"), 0755))
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, "1.7.1", "pkg", "telegraf"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(agentBasePath, "1.7.1", "pkg", "telegraf", "telegraf"), []byte("exe"), 0755))
+	require.NoError(t, os.Symlink("../pkg/telegraf/telegraf", path.Join(agentBasePath, "1.7.1", "bin", "telegraf")))
+	// a version directory created before the download finished
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, "1.8.0"), 0755))
+	// a version directory where the executable was never written
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, "1.9.0", "bin"), 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(agentBasePath, "1.9.0", "bin", "telegraf"), []byte{}, 0755))
+	// leftover staging content
+	require.NoError(t, os.MkdirAll(path.Join(agentBasePath, ".staging-123", "version", "bin"), 0755))
+	require.NoError(t, os.Symlink("1.9.0", path.Join(agentBasePath, "CURRENT")))
+
+	_, err = agents.NewAgentsRunner()
+	require.NoError(t, err)
+
+	assert.FileExists(t, path.Join(agentBasePath, "1.7.0", "bin", "telegraf"))
+	assert.FileExists(t, path.Join(agentBasePath, "1.7.1", "bin", "telegraf"))
+	for _, name := range []string{"1.8.0", "1.9.0", ".staging-123", "CURRENT"} {
+		_, err = os.Lstat(path.Join(agentBasePath, name))
+		assert.True(t, os.IsNotExist(err), "%s should have been removed", name)
+	}
+}
+
+func sha256File(t *testing.T, filename string) string {
+	content, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestAgentsRunner_ProcessConfigure_Acks(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	agents.UnregisterAllAgentRunners()
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	agentsRunner, err := agents.NewAgentsRunner()
+	require.NoError(t, err)
+
+	mockSpecificAgentRunner := NewMockSpecificAgentRunner()
+	agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, mockSpecificAgentRunner)
+	pegomock.When(mockSpecificAgentRunner.ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).
+		ThenReturn(nil, errors.New("failed to create configs path"))
+
+	configure := &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{Id: "op-1", Revision: "1"},
+			{Id: "op-2", Revision: "5"},
+		},
+	}
+
+	// the whole instruction failed, so each operation is reported as failed
+	ack := agentsRunner.ProcessConfigure(configure)
+	assert.Equal(t, telemetry_edge.AgentType_TELEGRAF, ack.AgentType)
+	require.Len(t, ack.Operations, 2)
+	for i, opAck := range ack.Operations {
+		assert.Equal(t, configure.Operations[i].Id, opAck.Id)
+		assert.Equal(t, configure.Operations[i].Revision, opAck.Revision)
+		assert.False(t, opAck.Success)
+		assert.Equal(t, "failed to create configs path", opAck.Error)
+	}
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Never()).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.AnyBool())
+
+	configure.AgentType = telemetry_edge.AgentType_FILEBEAT
+	ack = agentsRunner.ProcessConfigure(configure)
+	require.Len(t, ack.Operations, 2)
+	assert.False(t, ack.Operations[0].Success)
+	assert.Contains(t, ack.Operations[0].Error, "unknown agent type")
+}
@@ -33,3 +33,11 @@ func TestNoAppliedConfigs(t *testing.T) {
 	assert.False(t, agents.IsNoAppliedConfigs(errors.New("not ours")))
 	assert.False(t, agents.IsNoAppliedConfigs(nil))
 }
+
+func TestIsChecksumMismatch(t *testing.T) {
+	err := errors.Wrap(agents.CreateChecksumMismatchError(), "wrapped")
+	assert.True(t, agents.IsChecksumMismatch(err))
+
+	assert.False(t, agents.IsChecksumMismatch(errors.New("not ours")))
+	assert.False(t, agents.IsChecksumMismatch(nil))
+}
@@ -19,12 +19,15 @@ package agents
 import (
 	"bufio"
 	"context"
+	"fmt"
+	"github.com/cenkalti/backoff"
 	"github.com/pkg/errors"
 	"github.com/racker/telemetry-envoy/config"
 	"github.com/racker/telemetry-envoy/telemetry_edge"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"io"
+	"os"
 	"os/exec"
 	"strings"
 	"sync"
@@ -44,17 +47,51 @@ type CommandHandler interface {
 	WaitOnAgentCommand(ctx context.Context, agentRunner SpecificAgentRunner, runningContext *AgentRunningContext)
 	Signal(runningContext *AgentRunningContext, signal syscall.Signal) error
 	Stop(runningContext *AgentRunningContext)
+	// IsCrashLooping indicates that restarts of the agent type have been suspended since it
+	// failed too many times within the crash loop window
+	IsCrashLooping(agentType telemetry_edge.AgentType) bool
+	// ResetRestarts clears the restart backoff and crash looping state of the agent type, such as
+	// when new configuration or a new version might resolve the cause of the failures
+	ResetRestarts(agentType telemetry_edge.AgentType)
+	// WatchUpgrade has an unexpected exit of the agent type within the grace period call revert
+	// instead of restarting the agent. A grace period of zero clears the watch.
+	WatchUpgrade(agentType telemetry_edge.AgentType, gracePeriod time.Duration, revert func())
 }
 
-type StandardCommandHandler struct{}
+type StandardCommandHandler struct {
+	sync.Mutex
+	restarts map[telemetry_edge.AgentType]*agentRestarts
+	upgrades map[telemetry_edge.AgentType]*upgradeWatch
+}
+
+// upgradeWatch reverts an upgraded agent that exits before the end of the grace period
+type upgradeWatch struct {
+	until  time.Time
+	revert func()
+}
+
+// agentRestarts tracks the unexpected exits of an agent type in order to back off restarts
+// and detect crash looping
+type agentRestarts struct {
+	backOff      *backoff.ExponentialBackOff
+	failures     []time.Time
+	crashLooping bool
+}
 
 func init() {
 	viper.SetDefault(config.AgentsTerminationTimeoutConfig, 5*time.Second)
 	viper.SetDefault(config.AgentsRestartDelayConfig, 1*time.Second)
+	viper.SetDefault(config.AgentsMaxRestartDelay, 1*time.Minute)
+	viper.SetDefault(config.AgentsStableUptime, 1*time.Minute)
+	viper.SetDefault(config.AgentsCrashLoopThreshold, 5)
+	viper.SetDefault(config.AgentsCrashLoopWindow, 5*time.Minute)
 }
 
 func NewCommandHandler() CommandHandler {
-	return &StandardCommandHandler{}
+	return &StandardCommandHandler{
+		restarts: make(map[telemetry_edge.AgentType]*agentRestarts),
+		upgrades: make(map[telemetry_edge.AgentType]*upgradeWatch),
+	}
 }
 
 func (h *StandardCommandHandler) CreateContext(ctx context.Context, agentType telemetry_edge.AgentType, cmdName string, workingDir string, arg ...string) *AgentRunningContext {
@@ -68,6 +105,7 @@ func (h *StandardCommandHandler) CreateContext(ctx context.Context, agentType te
 		ctx:       cmdCtx,
 		cancel:    cancel,
 		cmd:       cmd,
+		output:    newOutputTail(viper.GetInt(config.AgentsEventOutputLines)),
 	}
 }
 
@@ -75,10 +113,11 @@ func (h *StandardCommandHandler) StartAgentCommand(runningContext *AgentRunningC
 	cmdCtx := runningContext.ctx
 	cmd := runningContext.cmd
 
-	waitForChan, err := h.setupCommandLogging(cmdCtx, agentType, cmd, waitFor)
+	waitForChan, outputDone, err := h.setupCommandLogging(cmdCtx, agentType, cmd, waitFor, runningContext.output)
 	if err != nil {
 		return errors.New("logging and watching command output")
 	}
+	runningContext.outputDone = outputDone
 
 	runningContext.stopping = false
 	runningContext.stopped = make(chan struct{}, 1)
@@ -91,21 +130,71 @@ func (h *StandardCommandHandler) StartAgentCommand(runningContext *AgentRunningC
 	if err != nil {
 		return errors.Wrap(err, "failed to start command")
 	}
+	runningContext.startedAt = time.Now()
+
+	if waitFor == "" {
+		postStartedEvent(runningContext)
+		return nil
+	}
 
 	select {
 	case <-time.After(waitForDuration):
+		abandonAgentCommand(runningContext)
 		return errors.New("failed to see expected content")
 	case result := <-waitForChan:
 		if result {
+			postStartedEvent(runningContext)
 			return nil
 		} else {
+			abandonAgentCommand(runningContext)
 			return errors.New("command exited before seeing expected content")
 		}
 	}
 }
 
+func postStartedEvent(runningContext *AgentRunningContext) {
+	postAgentEvent(&telemetry_edge.AgentEvent{
+		Agent: runningContext.agent(),
+		Type:  telemetry_edge.AgentEvent_STARTED,
+	})
+}
+
+// abandonAgentCommand kills and reaps an agent process that failed to start properly, since
+// the caller won't be tracking it
+func abandonAgentCommand(runningContext *AgentRunningContext) {
+	runningContext.Lock()
+	runningContext.stopping = true
+	cmd := runningContext.cmd
+	runningContext.Unlock()
+
+	err := cmd.Process.Kill()
+	if err != nil {
+		log.WithError(err).WithField("agentType", runningContext.agentType).Debug("failed to kill agent")
+	}
+
+	// the output needs to be read fully before waiting, but a process left behind by the agent
+	// could be holding onto the output
+	select {
+	case <-runningContext.outputDone:
+	case <-time.After(viper.GetDuration(config.AgentsTerminationTimeoutConfig)):
+		log.WithField("agentType", runningContext.agentType).Warn("agent output remained open after it was killed")
+	}
+	_ = cmd.Wait()
+
+	runningContext.Lock()
+	runningContext.cmd = nil
+	runningContext.Unlock()
+	runningContext.cancel()
+}
+
 func (h *StandardCommandHandler) WaitOnAgentCommand(ctx context.Context, agentRunner SpecificAgentRunner, runningContext *AgentRunningContext) {
-	err := runningContext.cmd.Wait()
+	agent := runningContext.agent()
+	runningContext.Lock()
+	cmd := runningContext.cmd
+	runningContext.Unlock()
+
+	err := cmd.Wait()
+	exitCode := cmd.ProcessState.ExitCode()
 	if err != nil {
 		log.WithError(err).
 			WithField("agentType", runningContext.agentType).
@@ -117,53 +206,203 @@ func (h *StandardCommandHandler) WaitOnAgentCommand(ctx context.Context, agentRu
 	}
 
 	// indicate child process termination for go routines and Stop handling
+	runningContext.Lock()
 	runningContext.cmd = nil
+	stopping := runningContext.stopping
+	runningContext.Unlock()
 	close(runningContext.stopped)
 	runningContext.cancel()
 
-	if !runningContext.stopping {
+	if !stopping {
+		postAgentEvent(&telemetry_edge.AgentEvent{
+			Agent:    agent,
+			Type:     telemetry_edge.AgentEvent_EXITED,
+			ExitCode: int32(exitCode),
+			Output:   runningContext.output.get(),
+		})
+
+		if revert := h.takeUpgradeRevert(runningContext.agentType); revert != nil {
+			log.
+				WithField("agentType", runningContext.agentType).
+				Warn("agent exited during upgrade grace period")
+			go revert()
+			return
+		}
+
+		delay, crashLooping := h.recordFailure(runningContext)
+		if crashLooping {
+			log.
+				WithField("agentType", runningContext.agentType).
+				Error("agent is crash looping, suspending restarts until the next configure or install instruction")
+			postAgentEvent(&telemetry_edge.AgentEvent{
+				Agent:   agent,
+				Type:    telemetry_edge.AgentEvent_CRASH_LOOPING,
+				Message: "restarts suspended until the next configure or install instruction",
+			})
+			return
+		}
+
 		log.
 			WithField("agentType", runningContext.agentType).
+			WithField("delay", delay).
 			Info("scheduling agent restart")
-		time.AfterFunc(viper.GetDuration(config.AgentsRestartDelayConfig), func() {
+		postAgentEvent(&telemetry_edge.AgentEvent{
+			Agent:   agent,
+			Type:    telemetry_edge.AgentEvent_RESTARTING,
+			Message: fmt.Sprintf("restarting in %v", delay),
+		})
+		time.AfterFunc(delay, func() {
 			agentRunner.EnsureRunningState(ctx, false)
 		})
 	}
 }
 
+// recordFailure tracks the unexpected exit of the agent process and returns the delay before
+// restarting the agent or true if the agent has been crash looping
+func (h *StandardCommandHandler) recordFailure(runningContext *AgentRunningContext) (time.Duration, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.restarts == nil {
+		h.restarts = make(map[telemetry_edge.AgentType]*agentRestarts)
+	}
+	restarts := h.restarts[runningContext.agentType]
+	if restarts == nil {
+		restarts = &agentRestarts{}
+		h.restarts[runningContext.agentType] = restarts
+	}
+	if restarts.backOff == nil {
+		restarts.backOff = newRestartBackOff()
+	}
+
+	now := time.Now()
+	if now.Sub(runningContext.startedAt) >= viper.GetDuration(config.AgentsStableUptime) {
+		// it was running long enough that the failure isn't part of a series
+		restarts.backOff.Reset()
+		restarts.failures = nil
+	}
+
+	windowStart := now.Add(-viper.GetDuration(config.AgentsCrashLoopWindow))
+	recent := restarts.failures[:0]
+	for _, failure := range restarts.failures {
+		if failure.After(windowStart) {
+			recent = append(recent, failure)
+		}
+	}
+	restarts.failures = append(recent, now)
+
+	threshold := viper.GetInt(config.AgentsCrashLoopThreshold)
+	if threshold > 0 && len(restarts.failures) >= threshold {
+		restarts.crashLooping = true
+		return 0, true
+	}
+
+	return restarts.backOff.NextBackOff(), false
+}
+
+func newRestartBackOff() *backoff.ExponentialBackOff {
+	restartBackOff := backoff.NewExponentialBackOff()
+	restartBackOff.InitialInterval = viper.GetDuration(config.AgentsRestartDelayConfig)
+	restartBackOff.MaxInterval = viper.GetDuration(config.AgentsMaxRestartDelay)
+	// restarts are limited by crash loop detection instead
+	restartBackOff.MaxElapsedTime = 0
+	restartBackOff.Reset()
+	return restartBackOff
+}
+
+func (h *StandardCommandHandler) IsCrashLooping(agentType telemetry_edge.AgentType) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	restarts := h.restarts[agentType]
+	return restarts != nil && restarts.crashLooping
+}
+
+func (h *StandardCommandHandler) ResetRestarts(agentType telemetry_edge.AgentType) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.restarts, agentType)
+}
+
+func (h *StandardCommandHandler) WatchUpgrade(agentType telemetry_edge.AgentType, gracePeriod time.Duration, revert func()) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.upgrades == nil {
+		h.upgrades = make(map[telemetry_edge.AgentType]*upgradeWatch)
+	}
+	if gracePeriod <= 0 {
+		delete(h.upgrades, agentType)
+		return
+	}
+	h.upgrades[agentType] = &upgradeWatch{
+		until:  time.Now().Add(gracePeriod),
+		revert: revert,
+	}
+}
+
+// takeUpgradeRevert consumes the upgrade watch of the agent type and returns its revert function,
+// if the grace period hasn't passed yet
+func (h *StandardCommandHandler) takeUpgradeRevert(agentType telemetry_edge.AgentType) func() {
+	h.Lock()
+	defer h.Unlock()
+
+	watch := h.upgrades[agentType]
+	delete(h.upgrades, agentType)
+	if watch == nil || time.Now().After(watch.until) {
+		return nil
+	}
+	return watch.revert
+}
+
 func (h *StandardCommandHandler) Signal(runningContext *AgentRunningContext, signal syscall.Signal) error {
-	if runningContext.IsRunning() {
+	if process := runningContext.process(); process != nil {
 		log.WithField("agentType", runningContext.agentType).Debug("sending HUP signal to agent")
 
-		return runningContext.cmd.Process.Signal(signal)
+		return process.Signal(signal)
 	} else {
 		return nil
 	}
 }
 
-func (h *StandardCommandHandler) setupCommandLogging(ctx context.Context, agentType telemetry_edge.AgentType, cmd *exec.Cmd, waitFor string) (<-chan bool, error) {
+// setupCommandLogging forwards the command's output to the logs. The returned outputDone channel
+// is closed once the output has been read fully.
+func (h *StandardCommandHandler) setupCommandLogging(ctx context.Context, agentType telemetry_edge.AgentType, cmd *exec.Cmd, waitFor string,
+	output *outputTail) (waitForChan <-chan bool, outputDone <-chan struct{}, err error) {
+
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	stderrPipe, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, err
-	}
-
-	waitForChan := make(chan bool, 1)
-	if waitFor == "" {
-		waitForChan <- true
+		return nil, nil, err
 	}
 
-	go h.handleCommandOutputPipe(ctx, "stdout", stdoutPipe, agentType, waitFor, waitForChan)
-	go h.handleCommandOutputPipe(ctx, "stderr", stderrPipe, agentType, waitFor, waitForChan)
-
-	return waitForChan, nil
+	waitForResult := make(chan bool, 1)
+	done := make(chan struct{})
+
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		h.handleCommandOutputPipe(ctx, "stdout", stdoutPipe, agentType, waitFor, waitForResult, output)
+	}()
+	go func() {
+		defer readers.Done()
+		h.handleCommandOutputPipe(ctx, "stderr", stderrPipe, agentType, waitFor, waitForResult, output)
+	}()
+	go func() {
+		readers.Wait()
+		close(done)
+	}()
+
+	return waitForResult, done, nil
 }
 
-func (*StandardCommandHandler) handleCommandOutputPipe(ctx context.Context, outputType string, stdoutPipe io.ReadCloser, agentType telemetry_edge.AgentType, waitFor string, waitForChan chan bool) {
+func (*StandardCommandHandler) handleCommandOutputPipe(ctx context.Context, outputType string, stdoutPipe io.ReadCloser, agentType telemetry_edge.AgentType, waitFor string, waitForChan chan bool, output *outputTail) {
 	stdoutReader := bufio.NewReader(stdoutPipe)
 	//noinspection GoUnhandledErrorResult
 	defer stdoutPipe.Close()
@@ -183,20 +422,30 @@ func (*StandardCommandHandler) handleCommandOutputPipe(ctx context.Context, outp
 				if err != io.EOF {
 					log.WithError(err).WithField("agentType", agentType).Warnf("while reading command's %s", outputType)
 				}
-				waitForChan <- false
+				notifyWaitFor(waitForChan, false)
 				return
 			}
 			log.WithField("agentType", agentType).Info(line)
+			output.add(line)
 
 			if checkingWaitFor && strings.Contains(line, waitFor) {
 				log.WithField("agentType", agentType).Debug("saw expected content")
-				waitForChan <- true
+				notifyWaitFor(waitForChan, true)
 				checkingWaitFor = false
 			}
 		}
 	}
 }
 
+// notifyWaitFor reports the outcome of waiting for content without blocking, since only the first
+// outcome is consumed and nothing is consumed when not waiting for content
+func notifyWaitFor(waitForChan chan bool, result bool) {
+	select {
+	case waitForChan <- result:
+	default:
+	}
+}
+
 func (*StandardCommandHandler) Stop(runningContext *AgentRunningContext) {
 	if runningContext == nil {
 		return
@@ -204,12 +453,12 @@ func (*StandardCommandHandler) Stop(runningContext *AgentRunningContext) {
 
 	runningContext.Lock()
 
-	if !runningContext.stopping && runningContext.IsRunning() {
+	if process := runningContext.runningProcess(); !runningContext.stopping && process != nil {
 		log.WithField("agentType", runningContext.agentType).Debug("stopping agent")
 		runningContext.stopping = true
 		runningContext.Unlock()
 
-		err := runningContext.cmd.Process.Signal(syscall.SIGTERM)
+		err := process.Signal(syscall.SIGTERM)
 		if err != nil {
 			log.WithField("agentType", runningContext.agentType).WithError(err).Warn("failed to send TERM signal")
 		}
@@ -217,7 +466,7 @@ func (*StandardCommandHandler) Stop(runningContext *AgentRunningContext) {
 		select {
 		case <-time.After(viper.GetDuration(config.AgentsTerminationTimeoutConfig)):
 			log.WithField("agentType", runningContext.agentType).Warn("agent process did not stop in time using TERM, now using KILL")
-			err = runningContext.cmd.Process.Signal(syscall.SIGKILL)
+			err = process.Signal(syscall.SIGKILL)
 			if err != nil {
 				log.WithField("agentType", runningContext.agentType).WithError(err).Warn("failed to send KILL signal")
 			}
@@ -235,25 +484,64 @@ func (*StandardCommandHandler) Stop(runningContext *AgentRunningContext) {
 // AgentRunningContext encapsulates the state of a running agent process
 // This should be created using CommandHandler's CreateContext
 type AgentRunningContext struct {
+	// guards cmd and stopping, which change as the process is stopped and reaped
 	sync.Mutex
 	agentType telemetry_edge.AgentType
 	// ctx and cancel are used to coordinate the lifecycle of go routines used by the CommandHandler
 	ctx    context.Context
 	cancel context.CancelFunc
-	cmd    *exec.Cmd
+	// cmd is nil once the process has been reaped
+	cmd *exec.Cmd
+	// closed once the process's output has been read fully
+	outputDone <-chan struct{}
 	// indicates that a command handler has started a Stop handling of this context
 	stopping bool
 	// a channel used a semaphore to enable blocking on child process during stopping process
 	stopped chan struct{}
+	// when the process was started, which is used to determine if it had been running stably
+	startedAt time.Time
+	// the most recent output of the process, which is reported when it exits
+	output *outputTail
 }
 
 func (c *AgentRunningContext) IsRunning() bool {
-	return c != nil && c.cmd != nil && (c.cmd.ProcessState == nil || !c.cmd.ProcessState.Exited())
+	if c == nil {
+		return false
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.cmd != nil
+}
+
+// process returns the agent's process or nil if it is not running
+func (c *AgentRunningContext) process() *os.Process {
+	c.Lock()
+	defer c.Unlock()
+	return c.runningProcess()
+}
+
+// runningProcess is the same as process, but for callers that hold the lock
+func (c *AgentRunningContext) runningProcess() *os.Process {
+	if c.cmd == nil {
+		return nil
+	}
+	return c.cmd.Process
+}
+
+// agent identifies the agent type and the version currently installed in the working directory
+func (c *AgentRunningContext) agent() *telemetry_edge.Agent {
+	agent := &telemetry_edge.Agent{Type: c.agentType}
+	c.Lock()
+	defer c.Unlock()
+	if c.cmd != nil {
+		agent.Version = currentVersion(c.cmd.Dir)
+	}
+	return agent
 }
 
 func (c *AgentRunningContext) Pid() int {
-	if c.IsRunning() {
-		return c.cmd.Process.Pid
+	if process := c.process(); process != nil {
+		return process.Pid
 	} else {
 		return -1
 	}
@@ -141,3 +141,97 @@ func TestStandardCommandHandler_WaitOnAgentCommand(t *testing.T) {
 		10*time.Millisecond,
 	).EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
 }
+
+func runFailingAgent(t *testing.T, commandHandler agents.CommandHandler, agentRunner agents.SpecificAgentRunner) {
+	runningContext := commandHandler.CreateContext(context.Background(), telemetry_edge.AgentType_TELEGRAF,
+		"./sleep_a_little", "testdata")
+
+	err := agents.RunAgentRunningContext(runningContext)
+	require.NoError(t, err)
+
+	commandHandler.WaitOnAgentCommand(context.Background(), agentRunner, runningContext)
+}
+
+func TestStandardCommandHandler_WaitOnAgentCommand_CrashLoop(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	agents.SetAgentRestartDelay(1 * time.Millisecond)
+	agents.SetAgentCrashLoop(3, 1*time.Minute, 1*time.Minute)
+	defer agents.SetAgentCrashLoop(5, 5*time.Minute, 1*time.Minute)
+
+	commandHandler := agents.NewCommandHandler()
+	agentRunner := NewMockSpecificAgentRunner()
+
+	for i := 0; i < 3; i++ {
+		runFailingAgent(t, commandHandler, agentRunner)
+	}
+
+	assert.True(t, commandHandler.IsCrashLooping(telemetry_edge.AgentType_TELEGRAF))
+	assert.False(t, commandHandler.IsCrashLooping(telemetry_edge.AgentType_FILEBEAT))
+	// only the first two failures were restarted
+	time.Sleep(50 * time.Millisecond)
+	agentRunner.VerifyWasCalled(pegomock.Times(2)).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+
+	commandHandler.ResetRestarts(telemetry_edge.AgentType_TELEGRAF)
+	assert.False(t, commandHandler.IsCrashLooping(telemetry_edge.AgentType_TELEGRAF))
+
+	runFailingAgent(t, commandHandler, agentRunner)
+	agentRunner.VerifyWasCalledEventually(pegomock.Times(3), 50*time.Millisecond).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+}
+
+func TestStandardCommandHandler_WaitOnAgentCommand_StableUptime(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	agents.SetAgentRestartDelay(1 * time.Millisecond)
+	// every run of the agent is long enough to be considered stable
+	agents.SetAgentCrashLoop(2, 1*time.Minute, 1*time.Millisecond)
+	defer agents.SetAgentCrashLoop(5, 5*time.Minute, 1*time.Minute)
+
+	commandHandler := agents.NewCommandHandler()
+	agentRunner := NewMockSpecificAgentRunner()
+
+	for i := 0; i < 3; i++ {
+		runFailingAgent(t, commandHandler, agentRunner)
+	}
+
+	assert.False(t, commandHandler.IsCrashLooping(telemetry_edge.AgentType_TELEGRAF))
+	agentRunner.VerifyWasCalledEventually(pegomock.Times(3), 50*time.Millisecond).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+}
+
+func TestStandardCommandHandler_WaitOnAgentCommand_WatchUpgrade(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	agents.SetAgentRestartDelay(1 * time.Millisecond)
+
+	commandHandler := agents.NewCommandHandler()
+	agentRunner := NewMockSpecificAgentRunner()
+
+	reverted := make(chan struct{}, 1)
+	commandHandler.WatchUpgrade(telemetry_edge.AgentType_TELEGRAF, 1*time.Minute, func() {
+		reverted <- struct{}{}
+	})
+	runFailingAgent(t, commandHandler, agentRunner)
+
+	select {
+	case <-reverted:
+	case <-time.After(1 * time.Second):
+		t.Fatal("did not see upgrade reverted")
+	}
+	agentRunner.VerifyWasCalled(pegomock.Never()).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+
+	// the watch is only used once and is not used after the grace period
+	commandHandler.WatchUpgrade(telemetry_edge.AgentType_TELEGRAF, 1*time.Nanosecond, func() {
+		reverted <- struct{}{}
+	})
+	time.Sleep(1 * time.Millisecond)
+	runFailingAgent(t, commandHandler, agentRunner)
+	runFailingAgent(t, commandHandler, agentRunner)
+
+	agentRunner.VerifyWasCalledEventually(pegomock.Times(2), 50*time.Millisecond).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+	assert.Empty(t, reverted)
+}
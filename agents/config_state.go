@@ -0,0 +1,199 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// appliedConfigsFilename is the file, within an agent's base path, that records the configuration
+// operations applied to that agent
+const appliedConfigsFilename = "applied-configs.json"
+
+// appliedConfig records the most recently applied revision of a configuration operation
+type appliedConfig struct {
+	Revision string `json:"revision"`
+	// Removed is retained so that a stale create or modify is not applied after a removal
+	Removed bool `json:"removed,omitempty"`
+}
+
+// appliedConfigs is the persisted state of the configuration operations applied to one agent type
+type appliedConfigs struct {
+	statePath string
+	// Ops is keyed by configuration operation id
+	Ops map[string]*appliedConfig `json:"ops"`
+}
+
+// loadAppliedConfigs reads the applied configuration state from the agent's base path. The returned
+// boolean is false if no state had been persisted yet.
+func loadAppliedConfigs(agentBasePath string) (*appliedConfigs, bool, error) {
+	state := &appliedConfigs{
+		statePath: path.Join(agentBasePath, appliedConfigsFilename),
+		Ops:       make(map[string]*appliedConfig),
+	}
+
+	content, err := ioutil.ReadFile(state.statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, false, nil
+		}
+		return state, false, errors.Wrap(err, "failed to read applied configs state")
+	}
+
+	err = json.Unmarshal(content, state)
+	if err != nil {
+		return state, false, errors.Wrap(err, "failed to parse applied configs state")
+	}
+	if state.Ops == nil {
+		state.Ops = make(map[string]*appliedConfig)
+	}
+
+	return state, true, nil
+}
+
+// isStale tests if the given operation has a lower revision than the one previously applied
+func (s *appliedConfigs) isStale(op *telemetry_edge.ConfigurationOp) (bool, string) {
+	applied, exists := s.Ops[op.GetId()]
+	if !exists {
+		return false, ""
+	}
+	return compareRevisions(op.GetRevision(), applied.Revision) < 0, applied.Revision
+}
+
+func (s *appliedConfigs) record(op *telemetry_edge.ConfigurationOp) {
+	s.Ops[op.GetId()] = &appliedConfig{
+		Revision: op.GetRevision(),
+		Removed:  op.GetType() == telemetry_edge.ConfigurationOp_REMOVE,
+	}
+}
+
+// save atomically replaces the persisted state
+func (s *appliedConfigs) save() error {
+	content, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode applied configs state")
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.statePath), dirPerms)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory for applied configs state")
+	}
+
+	// synced before the rename, so that a crash can't leave behind a renamed, but empty, file
+	tempPath := s.statePath + ".tmp"
+	os.Remove(tempPath)
+	err = writeFile(tempPath, bytes.NewReader(content), configFilePerms)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to write applied configs state")
+	}
+
+	err = os.Rename(tempPath, s.statePath)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to replace applied configs state")
+	}
+
+	err = syncDir(filepath.Dir(s.statePath))
+	if err != nil {
+		return errors.Wrap(err, "failed to sync applied configs state directory")
+	}
+
+	return nil
+}
+
+// removeUnknownConfigs removes config instance files from the configs directory that are not
+// recorded as applied, such as those left behind by an interrupted operation
+func (s *appliedConfigs) removeUnknownConfigs(configsPath string) {
+	entries, err := ioutil.ReadDir(configsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", configsPath).Warn("unable to read configs directory")
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		id := configIdOf(entry.Name())
+		if applied, exists := s.Ops[id]; exists && !applied.Removed {
+			continue
+		}
+
+		configPath := path.Join(configsPath, entry.Name())
+		log.WithField("path", configPath).Debug("removing config that is not recorded as applied")
+		err := os.RemoveAll(configPath)
+		if err != nil {
+			log.WithError(err).WithField("path", configPath).Warn("failed to remove unknown config")
+		}
+	}
+}
+
+// configIdsInDir returns the ids of the config instance files in the configs directory
+func configIdsInDir(configsPath string) []string {
+	entries, err := ioutil.ReadDir(configsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", configsPath).Warn("unable to read configs directory")
+		}
+		return nil
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		ids = append(ids, configIdOf(entry.Name()))
+	}
+	return ids
+}
+
+// configIdOf derives the configuration operation id from the name of a config instance file
+func configIdOf(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename))
+}
+
+// compareRevisions returns a negative value if revision a is older than b, zero if they're
+// the same, and a positive value if a is newer. Revisions are compared numerically when both are
+// integers and otherwise lexically. An empty revision is never considered older.
+func compareRevisions(a string, b string) int {
+	if a == "" || b == "" {
+		return 0
+	}
+
+	aNum, aErr := strconv.ParseInt(a, 10, 64)
+	bNum, bErr := strconv.ParseInt(b, 10, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case aNum < bNum:
+			return -1
+		case aNum > bNum:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/agents/matchers"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func setupConfigStateTest(t *testing.T, dataPath string) (agents.Router, *MockSpecificAgentRunner) {
+	agents.UnregisterAllAgentRunners()
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	mockSpecificAgentRunner := NewMockSpecificAgentRunner()
+	agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, mockSpecificAgentRunner)
+
+	agentsRunner, err := agents.NewAgentsRunner()
+	require.NoError(t, err)
+
+	return agentsRunner, mockSpecificAgentRunner
+}
+
+func configureOp(id string, revision string) *telemetry_edge.EnvoyInstructionConfigure {
+	return &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{Id: id, Revision: revision, Type: telemetry_edge.ConfigurationOp_MODIFY},
+		},
+	}
+}
+
+func TestAgentsRunner_ProcessConfigure_IgnoresStaleOps(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	pegomock.When(mockSpecificAgentRunner.ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).
+		ThenReturn([]*telemetry_edge.ConfigurationOpAck{{Id: "op-1", Success: true}}, nil)
+
+	ack := agentsRunner.ProcessConfigure(configureOp("op-1", "5"))
+	require.Len(t, ack.Operations, 1)
+	assert.True(t, ack.Operations[0].Success)
+
+	ack = agentsRunner.ProcessConfigure(configureOp("op-1", "3"))
+	require.Len(t, ack.Operations, 1)
+	assert.False(t, ack.Operations[0].Success)
+	assert.Contains(t, ack.Operations[0].Error, "stale")
+	mockSpecificAgentRunner.VerifyWasCalledOnce().
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())
+
+	// revisions are compared numerically
+	ack = agentsRunner.ProcessConfigure(configureOp("op-1", "10"))
+	require.Len(t, ack.Operations, 1)
+	assert.True(t, ack.Operations[0].Success)
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())
+
+	// the applied revisions are retained across restarts
+	agentsRunner, mockSpecificAgentRunner = setupConfigStateTest(t, dataPath)
+	ack = agentsRunner.ProcessConfigure(configureOp("op-1", "9"))
+	require.Len(t, ack.Operations, 1)
+	assert.False(t, ack.Operations[0].Success)
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Never()).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())
+}
+
+func TestAgentsRunner_ProcessConfigure_AcksInOrder(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	stubSuccessfulProcessConfig(mockSpecificAgentRunner)
+
+	agentsRunner.ProcessConfigure(configureOp("op-2", "5"))
+
+	ack := agentsRunner.ProcessConfigure(&telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{Id: "op-1", Revision: "1", Type: telemetry_edge.ConfigurationOp_CREATE},
+			{Id: "op-2", Revision: "3", Type: telemetry_edge.ConfigurationOp_MODIFY},
+			{Id: "op-3", Revision: "1", Type: telemetry_edge.ConfigurationOp_CREATE},
+		},
+	})
+
+	require.Len(t, ack.Operations, 3)
+	var ids []string
+	for _, opAck := range ack.Operations {
+		ids = append(ids, opAck.Id)
+	}
+	assert.Equal(t, []string{"op-1", "op-2", "op-3"}, ids)
+	assert.True(t, ack.Operations[0].Success)
+	assert.False(t, ack.Operations[1].Success)
+	assert.True(t, ack.Operations[2].Success)
+}
+
+func TestNewAgentsRunner_RetainsAppliedConfigs(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	configsPath := path.Join(dataPath, "agents", "TELEGRAF", "config.d")
+	require.NoError(t, os.MkdirAll(configsPath, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(configsPath, "op-1.conf"), []byte("applied"), 0600))
+
+	// without any recorded state, the configs can't be trusted
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	_, err = os.Stat(configsPath)
+	assert.True(t, os.IsNotExist(err), "configs should have been purged")
+
+	require.NoError(t, os.MkdirAll(configsPath, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(configsPath, "op-1.conf"), []byte("applied"), 0600))
+	pegomock.When(mockSpecificAgentRunner.ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).
+		ThenReturn([]*telemetry_edge.ConfigurationOpAck{{Id: "op-1", Success: true}}, nil)
+	agentsRunner.ProcessConfigure(configureOp("op-1", "1"))
+
+	// such as left behind by an operation that was interrupted
+	require.NoError(t, ioutil.WriteFile(path.Join(configsPath, "op-2.conf"), []byte("unknown"), 0600))
+
+	setupConfigStateTest(t, dataPath)
+	assert.FileExists(t, path.Join(configsPath, "op-1.conf"))
+	_, err = os.Stat(path.Join(configsPath, "op-2.conf"))
+	assert.True(t, os.IsNotExist(err), "unknown config should have been removed")
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault(config.AgentsDownloadConnectTimeout, 30*time.Second)
+	viper.SetDefault(config.AgentsDownloadTimeout, 10*time.Minute)
+	viper.SetDefault(config.AgentsDownloadRetries, 3)
+	viper.SetDefault(config.AgentsDownloadRetryDelay, 1*time.Second)
+}
+
+// agentDownloader retrieves agent packages using the HTTP client settings configured
+// under agents.download
+type agentDownloader struct {
+	client     *http.Client
+	retries    int
+	retryDelay time.Duration
+}
+
+func newAgentDownloader() (*agentDownloader, error) {
+	transport, err := newDownloadTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	return &agentDownloader{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   viper.GetDuration(config.AgentsDownloadTimeout),
+		},
+		retries:    viper.GetInt(config.AgentsDownloadRetries),
+		retryDelay: viper.GetDuration(config.AgentsDownloadRetryDelay),
+	}, nil
+}
+
+func newDownloadTransport() (*http.Transport, error) {
+	connectTimeout := viper.GetDuration(config.AgentsDownloadConnectTimeout)
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   connectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: connectTimeout,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if proxy := viper.GetString(config.AgentsDownloadProxy); proxy != "" {
+		proxyUrl, err := url.Parse(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid agent download proxy: %s", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if caFile := viper.GetString(config.AgentsDownloadCaFile); caFile != "" {
+		caPem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read agent download CA file")
+		}
+
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			log.WithError(err).Debug("system cert pool unavailable, using only agent download CA file")
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caPem) {
+			return nil, errors.Errorf("no certificates found in agent download CA file: %s", caFile)
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			RootCAs: certPool,
+		}
+	}
+
+	return transport, nil
+}
+
+// download retrieves the content at url into file, which is expected to be empty. The content
+// is also written to the hasher as it streams into the file. Interrupted transfers are retried
+// and resumed with a Range request, when the server supports it.
+func (d *agentDownloader) download(file *os.File, url string, hasher hash.Hash) error {
+	var received int64
+	attempts := 0
+
+	err := backoff.RetryNotify(func() error {
+		attempts++
+		var err error
+		received, err = d.attempt(file, url, hasher, received)
+		return err
+	}, d.newBackOff(),
+		func(err error, delay time.Duration) {
+			log.WithError(err).WithFields(log.Fields{
+				"url":      url,
+				"received": received,
+				"delay":    delay,
+			}).Warn("agent download failed, will retry")
+		})
+
+	if err != nil {
+		downloadErr := &downloadError{
+			url:      url,
+			attempts: attempts,
+			err:      err,
+		}
+		if statusErr, ok := err.(*unexpectedStatusError); ok {
+			downloadErr.statusCode = statusErr.statusCode
+		}
+		return downloadErr
+	}
+
+	return nil
+}
+
+func (d *agentDownloader) newBackOff() backoff.BackOff {
+	exponential := backoff.NewExponentialBackOff()
+	exponential.InitialInterval = d.retryDelay
+	// the number of retries bounds the overall effort instead
+	exponential.MaxElapsedTime = 0
+
+	var retries uint64
+	if d.retries > 0 {
+		retries = uint64(d.retries)
+	}
+	return backoff.WithMaxRetries(exponential, retries)
+}
+
+// attempt performs a single request for the content at url, resuming at the offset given by
+// received. It returns the total amount of content received so far, which might have been reset
+// to zero if the server didn't honor the resume request.
+func (d *agentDownloader) attempt(file *os.File, url string, hasher hash.Hash, received int64) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return received, backoff.Permanent(errors.Wrap(err, "invalid agent download URL"))
+	}
+	if received > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", received))
+	}
+
+	log.WithFields(log.Fields{
+		"url":    url,
+		"offset": received,
+	}).Debug("downloading agent")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return received, err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if received > 0 {
+			log.WithField("url", url).Debug("server ignored resume request, restarting download")
+			err = restartDownload(file, hasher)
+			if err != nil {
+				return received, backoff.Permanent(err)
+			}
+			received = 0
+		}
+
+	case resp.StatusCode == http.StatusPartialContent && received > 0:
+		expectedRange := fmt.Sprintf("bytes %d-", received)
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), expectedRange) {
+			err = restartDownload(file, hasher)
+			if err != nil {
+				return received, backoff.Permanent(err)
+			}
+			return 0, errors.Errorf("unexpected content range in resumed download: %s",
+				resp.Header.Get("Content-Range"))
+		}
+
+	default:
+		statusErr := &unexpectedStatusError{
+			statusCode: resp.StatusCode,
+			status:     resp.Status,
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && received > 0 {
+			err = restartDownload(file, hasher)
+			if err != nil {
+				return received, backoff.Permanent(err)
+			}
+			return 0, statusErr
+		}
+		if statusErr.retryable() {
+			return received, statusErr
+		}
+		return received, backoff.Permanent(statusErr)
+	}
+
+	n, err := io.Copy(&hashingWriter{file: file, hasher: hasher}, resp.Body)
+	received += n
+	if err != nil {
+		return received, errors.Wrap(err, "failed to save agent download")
+	}
+
+	return received, nil
+}
+
+// restartDownload discards content received so far in order to start a download from the beginning
+func restartDownload(file *os.File, hasher hash.Hash) error {
+	hasher.Reset()
+
+	err := file.Truncate(0)
+	if err != nil {
+		return errors.Wrap(err, "unable to truncate agent download")
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "unable to rewind agent download")
+	}
+	return nil
+}
+
+// hashingWriter only hashes the content that was actually written to the file, so that the two
+// stay consistent when a download is resumed after a failed write
+type hashingWriter struct {
+	file   io.Writer
+	hasher hash.Hash
+}
+
+func (w *hashingWriter) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hasher.Write(p[:n])
+	return n, err
+}
+
+type unexpectedStatusError struct {
+	statusCode int
+	status     string
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected HTTP status: %s", e.status)
+}
+
+// retryable indicates if the status could be the result of a transient server condition
+func (e *unexpectedStatusError) retryable() bool {
+	return e.statusCode >= 500 ||
+		e.statusCode == http.StatusRequestTimeout ||
+		e.statusCode == http.StatusTooManyRequests
+}
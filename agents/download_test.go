@@ -0,0 +1,220 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testDownloadContent = []byte(strings.Repeat("agent package content ", 1000))
+
+// downloadTestContent runs a verified download of testDownloadContent from url and returns the
+// content that was saved
+func downloadTestContent(t *testing.T, url string) ([]byte, error) {
+	viper.Set(config.AgentsDownloadRetryDelay, 1*time.Millisecond)
+	defer viper.Set(config.AgentsDownloadRetryDelay, 1*time.Second)
+
+	file, err := ioutil.TempFile("", "test_download")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	sum := sha256.Sum256(testDownloadContent)
+	err = agents.DownloadVerified(file, url, &telemetry_edge.Checksum{
+		Type:  telemetry_edge.Checksum_SHA256,
+		Value: hex.EncodeToString(sum[:]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(file.Name())
+	require.NoError(t, err)
+	return content, nil
+}
+
+func TestDownload_RetriesServerErrors(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write(testDownloadContent)
+	}))
+	defer ts.Close()
+
+	content, err := downloadTestContent(t, ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, testDownloadContent, content)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestDownload_NotFound(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer ts.Close()
+
+	_, err := downloadTestContent(t, ts.URL)
+	require.Error(t, err)
+	assert.True(t, agents.IsDownloadError(err))
+	assert.Equal(t, http.StatusNotFound, agents.DownloadStatusCode(err))
+	assert.False(t, agents.IsChecksumMismatch(err))
+	// client errors are not retried
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestDownload_RetriesExhausted(t *testing.T) {
+	viper.Set(config.AgentsDownloadRetries, 2)
+	defer viper.Set(config.AgentsDownloadRetries, 3)
+
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	_, err := downloadTestContent(t, ts.URL)
+	require.Error(t, err)
+	assert.True(t, agents.IsDownloadError(err))
+	assert.Equal(t, http.StatusBadGateway, agents.DownloadStatusCode(err))
+	assert.Contains(t, err.Error(), "3 attempt(s)")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+// interruptedHandler sends only the first half of the content on the initial request and then
+// handles Range requests according to honorRange
+func interruptedHandler(t *testing.T, honorRange bool, ranges *[]string) http.HandlerFunc {
+	var requests int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		*ranges = append(*ranges, r.Header.Get("Range"))
+
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", len(testDownloadContent)))
+			_, _ = w.Write(testDownloadContent[:len(testDownloadContent)/2])
+			w.(http.Flusher).Flush()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			_ = conn.Close()
+			return
+		}
+
+		if honorRange && r.Header.Get("Range") != "" {
+			var start int
+			_, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+			require.NoError(t, err)
+			w.Header().Set("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d", start, len(testDownloadContent)-1, len(testDownloadContent)))
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write(testDownloadContent[start:])
+			return
+		}
+
+		_, _ = w.Write(testDownloadContent)
+	}
+}
+
+func TestDownload_Resume(t *testing.T) {
+	var ranges []string
+	ts := httptest.NewServer(interruptedHandler(t, true, &ranges))
+	defer ts.Close()
+
+	content, err := downloadTestContent(t, ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, testDownloadContent, content)
+
+	require.Len(t, ranges, 2)
+	assert.Equal(t, "", ranges[0])
+	assert.Equal(t, fmt.Sprintf("bytes=%d-", len(testDownloadContent)/2), ranges[1])
+}
+
+func TestDownload_ResumeNotSupported(t *testing.T) {
+	var ranges []string
+	ts := httptest.NewServer(interruptedHandler(t, false, &ranges))
+	defer ts.Close()
+
+	content, err := downloadTestContent(t, ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, testDownloadContent, content)
+	assert.Len(t, ranges, 2)
+}
+
+func TestDownload_CaFile(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(testDownloadContent)
+	}))
+	defer ts.Close()
+
+	// without the CA, the server's certificate is not trusted
+	_, err := downloadTestContent(t, ts.URL)
+	require.Error(t, err)
+	assert.True(t, agents.IsDownloadError(err))
+
+	caFile, err := ioutil.TempFile("", "test_ca")
+	require.NoError(t, err)
+	defer os.Remove(caFile.Name())
+	err = pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	require.NoError(t, err)
+	require.NoError(t, caFile.Close())
+
+	viper.Set(config.AgentsDownloadCaFile, caFile.Name())
+	defer viper.Set(config.AgentsDownloadCaFile, "")
+
+	content, err := downloadTestContent(t, ts.URL)
+	require.NoError(t, err)
+	assert.Equal(t, testDownloadContent, content)
+}
+
+func TestDownload_Proxy(t *testing.T) {
+	var proxiedUrl string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedUrl = r.URL.String()
+		_, _ = w.Write(testDownloadContent)
+	}))
+	defer proxy.Close()
+
+	viper.Set(config.AgentsDownloadProxy, proxy.URL)
+	defer viper.Set(config.AgentsDownloadProxy, "")
+
+	content, err := downloadTestContent(t, "http://agents.example.com/telegraf.tgz")
+	require.NoError(t, err)
+	assert.Equal(t, testDownloadContent, content)
+	assert.Equal(t, "http://agents.example.com/telegraf.tgz", proxiedUrl)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventPoster receives the lifecycle events of the agents, such as to report them to the Ambassador
+type EventPoster interface {
+	PostAgentEvent(event *telemetry_edge.AgentEvent)
+}
+
+var (
+	eventPosterMutex sync.RWMutex
+	eventPoster      EventPoster
+)
+
+func init() {
+	viper.SetDefault(config.AgentsEventOutputLines, 20)
+}
+
+// SetEventPoster registers the poster of agent lifecycle events. Events are discarded until one is set.
+func SetEventPoster(poster EventPoster) {
+	eventPosterMutex.Lock()
+	defer eventPosterMutex.Unlock()
+
+	eventPoster = poster
+}
+
+func postAgentEvent(event *telemetry_edge.AgentEvent) {
+	eventPosterMutex.RLock()
+	poster := eventPoster
+	eventPosterMutex.RUnlock()
+
+	if poster == nil {
+		return
+	}
+
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	poster.PostAgentEvent(event)
+}
+
+// outputTail retains the most recent lines output by an agent process
+type outputTail struct {
+	sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newOutputTail(size int) *outputTail {
+	if size <= 0 {
+		return nil
+	}
+	return &outputTail{
+		lines: make([]string, size),
+	}
+}
+
+func (o *outputTail) add(line string) {
+	if o == nil {
+		return
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	o.lines[o.next] = strings.TrimRight(line, "\r\n")
+	o.next = (o.next + 1) % len(o.lines)
+	if o.next == 0 {
+		o.full = true
+	}
+}
+
+// get returns the retained lines, oldest first
+func (o *outputTail) get() []string {
+	if o == nil {
+		return nil
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	if !o.full {
+		return append([]string(nil), o.lines[:o.next]...)
+	}
+	return append(append([]string(nil), o.lines[o.next:]...), o.lines[:o.next]...)
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"context"
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type capturingEventPoster struct {
+	sync.Mutex
+	events []*telemetry_edge.AgentEvent
+}
+
+func (p *capturingEventPoster) PostAgentEvent(event *telemetry_edge.AgentEvent) {
+	p.Lock()
+	defer p.Unlock()
+	p.events = append(p.events, event)
+}
+
+func (p *capturingEventPoster) eventTypes() []telemetry_edge.AgentEvent_Type {
+	p.Lock()
+	defer p.Unlock()
+
+	var types []telemetry_edge.AgentEvent_Type
+	for _, event := range p.events {
+		types = append(types, event.Type)
+	}
+	return types
+}
+
+func TestStandardCommandHandler_PostsAgentEvents(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	poster := &capturingEventPoster{}
+	agents.SetEventPoster(poster)
+	defer agents.SetEventPoster(nil)
+
+	agents.SetAgentRestartDelay(1 * time.Millisecond)
+	viper.Set(config.AgentsEventOutputLines, 3)
+	defer viper.Set(config.AgentsEventOutputLines, 20)
+
+	commandHandler := agents.NewCommandHandler()
+	runningContext := commandHandler.CreateContext(context.Background(), telemetry_edge.AgentType_TELEGRAF,
+		"./exits_with_output", "testdata")
+
+	err := commandHandler.StartAgentCommand(runningContext, telemetry_edge.AgentType_TELEGRAF, "line 1", time.Second)
+	require.NoError(t, err)
+
+	commandHandler.WaitOnAgentCommand(context.Background(), NewMockSpecificAgentRunner(), runningContext)
+
+	require.Equal(t, []telemetry_edge.AgentEvent_Type{
+		telemetry_edge.AgentEvent_STARTED,
+		telemetry_edge.AgentEvent_EXITED,
+		telemetry_edge.AgentEvent_RESTARTING,
+	}, poster.eventTypes())
+
+	exited := poster.events[1]
+	assert.Equal(t, telemetry_edge.AgentType_TELEGRAF, exited.Agent.Type)
+	assert.Equal(t, int32(3), exited.ExitCode)
+	assert.Equal(t, []string{"line 3", "line 4", "line 5"}, exited.Output)
+	assert.NotZero(t, exited.Timestamp)
+}
+
+func TestAgentsRunner_ProcessInstall_PostsAgentEvents(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	poster := &capturingEventPoster{}
+	agents.SetEventPoster(poster)
+	defer agents.SetEventPoster(nil)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, _ := setupVersionsTest(t, dataPath, "1.8.0")
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	install := telegrafInstall(t, ts.URL, "1.9.0")
+	install.Checksum.Value = "bad"
+	agentsRunner.ProcessInstall(install)
+
+	require.Equal(t, []telemetry_edge.AgentEvent_Type{
+		telemetry_edge.AgentEvent_INSTALLED,
+		telemetry_edge.AgentEvent_INSTALL_FAILED,
+	}, poster.eventTypes())
+	assert.Equal(t, "1.8.0", poster.events[0].Agent.Version)
+	assert.Equal(t, "1.9.0", poster.events[1].Agent.Version)
+	assert.Contains(t, poster.events[1].Message, "checksum mismatch")
+}
@@ -92,6 +92,7 @@ func (fbr *FilebeatRunner) EnsureRunningState(ctx context.Context, applyConfigs
 		telemetry_edge.AgentType_FILEBEAT,
 		fbr.exePath(), fbr.basePath,
 		"run",
+		"--path.home", fbr.homePath(),
 		"--path.config", "./",
 		"--path.data", "data",
 		"--path.logs", "logs")
@@ -115,37 +116,44 @@ func (fbr *FilebeatRunner) Stop() {
 	fbr.running = nil
 }
 
-func (fbr *FilebeatRunner) ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) error {
+func (fbr *FilebeatRunner) IsRunning() bool {
+	return fbr.running.IsRunning()
+}
+
+func (fbr *FilebeatRunner) ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) ([]*telemetry_edge.ConfigurationOpAck, error) {
 	configsPath := path.Join(fbr.basePath, configsDirSubpath)
 	err := os.MkdirAll(configsPath, dirPerms)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create configs path for filebeat: %v", configsPath)
+		return nil, errors.Wrapf(err, "failed to create configs path for filebeat: %v", configsPath)
 	}
 
 	mainConfigPath := path.Join(fbr.basePath, filebeatMainConfigFilename)
 	if !fileExists(mainConfigPath) {
 		err = fbr.createMainConfig(mainConfigPath)
 		if err != nil {
-			return errors.Wrap(err, "failed to create main filebeat config")
+			return nil, errors.Wrap(err, "failed to create main filebeat config")
 		}
 	}
 
+	acks := make([]*telemetry_edge.ConfigurationOpAck, 0, len(configure.GetOperations()))
 	applied := 0
 	for _, op := range configure.GetOperations() {
 		log.WithField("op", op).Debug("processing filebeat config operation")
 
 		configInstancePath := filepath.Join(configsPath, fmt.Sprintf("%s.yml", op.GetId()))
 
-		if handleContentConfigurationOp(op, configInstancePath, ConversionNone) {
+		err = handleContentConfigurationOp(op, configInstancePath, ConversionNone)
+		if err == nil {
 			applied++
 		}
+		acks = append(acks, newConfigurationOpAck(op, err))
 	}
 
 	if applied == 0 {
-		return &noAppliedConfigsError{}
+		return acks, &noAppliedConfigsError{}
 	}
 
-	return nil
+	return acks, nil
 }
 
 func (fbr *FilebeatRunner) createMainConfig(mainConfigPath string) error {
@@ -227,3 +235,17 @@ func (fbr *FilebeatRunner) hasRequiredPaths() bool {
 func (fbr *FilebeatRunner) exePath() string {
 	return filepath.Join(currentVerLink, binSubpath, "filebeat")
 }
+
+// homePath returns the absolute path of the directory containing the resolved executable. When the
+// full agent package was extracted, that is where filebeat will find its modules, fields.yml, etc.
+func (fbr *FilebeatRunner) homePath() string {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(fbr.basePath, fbr.exePath()))
+	if err == nil {
+		resolved, err = filepath.Abs(resolved)
+	}
+	if err != nil {
+		log.WithError(err).Warn("unable to resolve filebeat executable")
+		return filepath.Join(currentVerLink, binSubpath)
+	}
+	return filepath.Dir(resolved)
+}
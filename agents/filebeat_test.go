@@ -58,7 +58,7 @@ func TestFilebeatRunner_ProcessConfig_CreateModify(t *testing.T) {
 					},
 				},
 			}
-			err = runner.ProcessConfig(configure)
+			_, err = runner.ProcessConfig(configure)
 			require.NoError(t, err)
 
 			var files, mainConfigs, instanceConfigs int
@@ -41,8 +41,15 @@ func SetAgentRestartDelay(delay time.Duration) {
 	viper.Set(config.AgentsRestartDelayConfig, delay)
 }
 
+func SetAgentCrashLoop(threshold int, window time.Duration, stableUptime time.Duration) {
+	viper.Set(config.AgentsCrashLoopThreshold, threshold)
+	viper.Set(config.AgentsCrashLoopWindow, window)
+	viper.Set(config.AgentsStableUptime, stableUptime)
+}
+
 func RunAgentRunningContext(ctx *AgentRunningContext) error {
 	ctx.stopped = make(chan struct{}, 1)
+	ctx.startedAt = time.Now()
 	return ctx.cmd.Run()
 }
 
@@ -68,6 +75,22 @@ func CreateNoAppliedConfigsError() error {
 	return &noAppliedConfigsError{}
 }
 
+func CreateChecksumMismatchError() error {
+	return &checksumMismatchError{
+		checksumType: telemetry_edge.Checksum_SHA256,
+		expected:     "abc",
+		actual:       "def",
+	}
+}
+
+func DownloadVerified(file *os.File, url string, checksum *telemetry_edge.Checksum) error {
+	return downloadVerified(file, url, checksum)
+}
+
+func CommandHandlerOf(router Router) CommandHandler {
+	return router.(*StandardAgentsRouter).commandHandler
+}
+
 func CreatePreRunningAgentRunningContext() *AgentRunningContext {
 	return &AgentRunningContext{
 		cmd: &exec.Cmd{
@@ -0,0 +1,588 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	downloadFilename = "package"
+	stagedVersionDir = "version"
+	// pkgSubpath is where the entire agent package is extracted when using the FULL extract mode
+	pkgSubpath = "pkg"
+	// installedMarker records, within a version directory, when that version was installed
+	installedMarker = ".installed"
+	exePerms        = 0755
+)
+
+func init() {
+	// filebeat needs its modules, fields.yml, etc located next to its executable
+	viper.SetDefault(config.AgentsExtractModesConfig+".filebeat", "full")
+}
+
+// installAgentPackage downloads, verifies, and extracts the agent package described by the install
+// instruction into a staging directory. Only once the staged content is completely written and synced
+// to disk is it moved to its final location at <agentBasePath>/<version>.
+func installAgentPackage(agentBasePath string, install *telemetry_edge.EnvoyInstructionInstall) error {
+	err := os.MkdirAll(agentBasePath, dirPerms)
+	if err != nil {
+		return errors.Wrap(err, "unable to create agent base directory")
+	}
+
+	stagingPath, err := ioutil.TempDir(agentBasePath, stagingPrefix)
+	if err != nil {
+		return errors.Wrap(err, "unable to create staging directory")
+	}
+	//noinspection GoUnhandledErrorResult
+	defer os.RemoveAll(stagingPath)
+
+	pkgFile, err := os.Create(path.Join(stagingPath, downloadFilename))
+	if err != nil {
+		return errors.Wrap(err, "unable to create file for agent download")
+	}
+	//noinspection GoUnhandledErrorResult
+	defer pkgFile.Close()
+
+	err = downloadVerified(pkgFile, install.Url, install.Checksum)
+	if err != nil {
+		return err
+	}
+
+	// the package has been verified, so now it is safe to extract
+	_, err = pkgFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return errors.Wrap(err, "unable to rewind agent download")
+	}
+
+	stagedOutputPath := path.Join(stagingPath, stagedVersionDir)
+	err = os.Mkdir(stagedOutputPath, dirPerms)
+	if err != nil {
+		return errors.Wrap(err, "unable to create staged version directory")
+	}
+
+	extractor, err := newPackageExtractor(stagedOutputPath, install.Exe, resolveExtractMode(install))
+	if err != nil {
+		return err
+	}
+	err = extractPackage(pkgFile, install.GetPackageFormat(), extractor)
+	if err != nil {
+		return err
+	}
+
+	err = writeFile(path.Join(stagedOutputPath, installedMarker),
+		strings.NewReader(time.Now().UTC().Format(time.RFC3339Nano)), 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to record agent install time")
+	}
+
+	err = syncTree(stagedOutputPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to sync staged agent files")
+	}
+
+	outputPath := path.Join(agentBasePath, install.GetAgent().GetVersion())
+	err = os.Rename(stagedOutputPath, outputPath)
+	if err != nil {
+		return errors.Wrap(err, "unable to move staged agent into place")
+	}
+	return syncDir(agentBasePath)
+}
+
+// newChecksumHash creates the hash that corresponds to the type of the given checksum
+func newChecksumHash(checksum *telemetry_edge.Checksum) (hash.Hash, error) {
+	if checksum.GetValue() == "" {
+		return nil, errors.New("install instruction is missing a checksum")
+	}
+
+	switch checksum.GetType() {
+	case telemetry_edge.Checksum_SHA256:
+		return sha256.New(), nil
+	case telemetry_edge.Checksum_SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, errors.Errorf("unsupported checksum type: %v", checksum.GetType())
+	}
+}
+
+// downloadVerified downloads the content at url into the given file. The content is hashed while
+// it streams into the file and an error is returned if it doesn't match the given checksum.
+func downloadVerified(file *os.File, url string, checksum *telemetry_edge.Checksum) error {
+	hasher, err := newChecksumHash(checksum)
+	if err != nil {
+		return err
+	}
+
+	downloader, err := newAgentDownloader()
+	if err != nil {
+		return err
+	}
+
+	err = downloader.download(file, url, hasher)
+	if err != nil {
+		return err
+	}
+
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	expected := strings.TrimSpace(checksum.GetValue())
+	if !strings.EqualFold(actual, expected) {
+		return &checksumMismatchError{
+			checksumType: checksum.GetType(),
+			expected:     expected,
+			actual:       actual,
+		}
+	}
+
+	return nil
+}
+
+// packageEntry is a format-neutral view of a file, directory, or link within an agent package
+type packageEntry struct {
+	name string
+	// mode includes the type bits of os.FileMode to distinguish directories and symlinks
+	mode os.FileMode
+	// linkname is the target of a symlink or hard link
+	linkname string
+	hardLink bool
+	content  io.Reader
+}
+
+// packageExtractor writes the entries of an agent package into a version directory according to
+// the extraction mode. In either mode, the agent's executable ends up at bin/<exe filename>.
+type packageExtractor struct {
+	outputPath   string
+	exePath      string
+	mode         telemetry_edge.EnvoyInstructionInstall_ExtractMode
+	processedExe bool
+	// linkExe indicates the executable was extracted within the package directory and needs
+	// to be linked into the bin directory
+	linkExe bool
+}
+
+func newPackageExtractor(outputPath string, exePath string,
+	mode telemetry_edge.EnvoyInstructionInstall_ExtractMode) (*packageExtractor, error) {
+
+	err := os.Mkdir(path.Join(outputPath, binSubpath), dirPerms)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create bin directory")
+	}
+
+	if mode == telemetry_edge.EnvoyInstructionInstall_FULL {
+		err = os.Mkdir(path.Join(outputPath, pkgSubpath), dirPerms)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to create package directory")
+		}
+	}
+
+	return &packageExtractor{
+		outputPath: outputPath,
+		exePath:    exePath,
+		mode:       mode,
+	}, nil
+}
+
+func (x *packageExtractor) handleEntry(entry *packageEntry) error {
+	if x.mode == telemetry_edge.EnvoyInstructionInstall_FULL {
+		return x.extractEntry(entry)
+	}
+
+	if entry.name == x.exePath {
+		// packages such as zips created without Unix attributes don't mark the executable as such
+		return x.writeExecutable(entry.content, entry.mode.Perm()|exePerms)
+	}
+	return nil
+}
+
+// handleExecutable is used when the package content is the agent's executable itself
+func (x *packageExtractor) handleExecutable(content io.Reader) error {
+	return x.writeExecutable(content, exePerms)
+}
+
+func (x *packageExtractor) writeExecutable(content io.Reader, perm os.FileMode) error {
+	_, exeFilename := path.Split(x.exePath)
+	if exeFilename == "" {
+		return errors.New("install instruction is missing the agent executable")
+	}
+
+	err := writeFile(path.Join(x.outputPath, binSubpath, exeFilename), content, perm)
+	if err != nil {
+		return errors.Wrap(err, "unable to write agent executable")
+	}
+	x.processedExe = true
+	return nil
+}
+
+// extractEntry writes any type of entry within the package directory, but ensures that nothing
+// gets written, or linked, outside of the package directory.
+func (x *packageExtractor) extractEntry(entry *packageEntry) error {
+	name, err := cleanEntryName(entry.name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	perm := entry.mode.Perm()
+	if exeName, _ := cleanEntryName(x.exePath); name == exeName {
+		x.processedExe = true
+		x.linkExe = true
+		perm |= exePerms
+	}
+
+	pkgPath := path.Join(x.outputPath, pkgSubpath)
+	err = checkNoSymlinkParents(pkgPath, name)
+	if err != nil {
+		return err
+	}
+	target := path.Join(pkgPath, name)
+
+	switch {
+	case entry.mode.IsDir():
+		return os.MkdirAll(target, dirPerms)
+
+	case entry.mode&os.ModeSymlink != 0:
+		if _, ok := resolvePackageLink(pkgPath, path.Dir(name), entry.linkname, 0); !ok {
+			return errors.Errorf("symlink %s points outside of agent package: %s", entry.name, entry.linkname)
+		}
+		err = os.MkdirAll(path.Dir(target), dirPerms)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(entry.linkname, target)
+
+	case entry.hardLink:
+		linkTarget, err := cleanEntryName(entry.linkname)
+		if err != nil {
+			return err
+		}
+		err = checkNoSymlinkParents(pkgPath, linkTarget)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(path.Dir(target), dirPerms)
+		if err != nil {
+			return err
+		}
+		return os.Link(path.Join(pkgPath, linkTarget), target)
+
+	case entry.mode.IsRegular():
+		err = os.MkdirAll(path.Dir(target), dirPerms)
+		if err != nil {
+			return err
+		}
+		return writeFile(target, entry.content, perm)
+
+	default:
+		log.WithField("name", entry.name).Debug("skipping unsupported type of package entry")
+		return nil
+	}
+}
+
+// maxPackageLinkHops bounds how many symlinks are followed when resolving a symlink's target,
+// which also stops symlink loops
+const maxPackageLinkHops = 40
+
+// resolvePackageLink resolves the target of a symlink located at the relative dir of the package
+// directory by following the symlinks that were already extracted. It returns the resolved path,
+// relative to the package directory, and false if the target leads outside of the package
+// directory at any point. Once an entry that hasn't been extracted yet is reached, the remainder
+// of the target may only descend, since a symlink extracted there later could lead anywhere
+// within the package directory.
+func resolvePackageLink(pkgPath string, dir string, linkname string, hops int) (string, bool) {
+	if path.IsAbs(linkname) || hops > maxPackageLinkHops {
+		return "", false
+	}
+
+	current := dir
+	pending := false
+	for _, part := range strings.Split(linkname, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if pending || current == "." {
+				return "", false
+			}
+			current = path.Dir(current)
+			continue
+		}
+
+		current = path.Join(current, part)
+		if pending {
+			continue
+		}
+		info, err := os.Lstat(path.Join(pkgPath, current))
+		if os.IsNotExist(err) {
+			pending = true
+			continue
+		} else if err != nil {
+			return "", false
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path.Join(pkgPath, current))
+			if err != nil {
+				return "", false
+			}
+			var ok bool
+			current, ok = resolvePackageLink(pkgPath, path.Dir(current), target, hops+1)
+			if !ok {
+				return "", false
+			}
+		}
+	}
+	return current, true
+}
+
+func (x *packageExtractor) finish() error {
+	if !x.processedExe {
+		return errors.New("failed to find/process agent executable")
+	}
+
+	if x.linkExe {
+		exeName, _ := cleanEntryName(x.exePath)
+		binExePath := path.Join(x.outputPath, binSubpath, path.Base(exeName))
+		err := os.Symlink(path.Join("..", pkgSubpath, exeName), binExePath)
+		if err != nil {
+			return errors.Wrap(err, "unable to link agent executable")
+		}
+
+		resolved, err := filepath.EvalSymlinks(binExePath)
+		if err != nil {
+			return errors.Wrap(err, "unable to resolve agent executable")
+		}
+		resolvedBase, err := filepath.EvalSymlinks(x.outputPath)
+		if err != nil {
+			return errors.Wrap(err, "unable to resolve agent version directory")
+		}
+		if rel, err := filepath.Rel(resolvedBase, resolved); err != nil || strings.HasPrefix(rel, "..") {
+			return errors.New("agent executable resolves outside of the agent package")
+		}
+	}
+
+	return nil
+}
+
+// cleanEntryName normalizes the name of a package entry and rejects names that would escape
+// the directory where the package is extracted
+func cleanEntryName(name string) (string, error) {
+	if path.IsAbs(name) {
+		return "", errors.Errorf("package entry has an absolute path: %s", name)
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errors.Errorf("package entry is outside of the package: %s", name)
+	}
+	return cleaned, nil
+}
+
+// checkNoSymlinkParents ensures that writing the relative name within root won't traverse
+// any symlinks that were previously extracted, since those could lead outside of root
+func checkNoSymlinkParents(root string, name string) error {
+	current := root
+	parts := strings.Split(path.Dir(name), "/")
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		current = path.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return errors.Errorf("package entry %s would be written through a symlink", name)
+		}
+	}
+	return nil
+}
+
+// resolveExtractMode determines the extract mode for the install instruction, falling back to
+// the mode configured for the agent type
+func resolveExtractMode(install *telemetry_edge.EnvoyInstructionInstall) telemetry_edge.EnvoyInstructionInstall_ExtractMode {
+	if install.GetExtractMode() != telemetry_edge.EnvoyInstructionInstall_AGENT_DEFAULT {
+		return install.GetExtractMode()
+	}
+
+	agentType := install.GetAgent().GetType()
+	configured := viper.GetString(config.AgentsExtractModesConfig + "." + strings.ToLower(agentType.String()))
+	if mode, ok := telemetry_edge.EnvoyInstructionInstall_ExtractMode_value[strings.ToUpper(configured)]; ok &&
+		mode != int32(telemetry_edge.EnvoyInstructionInstall_AGENT_DEFAULT) {
+		return telemetry_edge.EnvoyInstructionInstall_ExtractMode(mode)
+	}
+	if configured != "" {
+		log.WithField("mode", configured).WithField("agentType", agentType).
+			Warn("ignoring unknown extract mode")
+	}
+	return telemetry_edge.EnvoyInstructionInstall_EXE_ONLY
+}
+
+// writeFile writes the content into a new file and ensures the content has been flushed to disk
+func writeFile(filename string, content io.Reader, mode os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	_, err = io.Copy(file, content)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir flushes the directory entries, such as a newly renamed child, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// syncTree flushes all of the directories within and including root to disk. Regular files
+// are expected to have been synced when written.
+func syncTree(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return syncDir(path)
+		}
+		return nil
+	})
+}
+
+// switchCurrentVersion atomically points the current version symlink at the given version
+// by creating a new symlink and renaming it over the existing one.
+func switchCurrentVersion(agentBasePath string, agentVersion string) error {
+	currentSymlinkPath := path.Join(agentBasePath, currentVerLink)
+	stagedSymlinkPath := path.Join(agentBasePath, stagingPrefix+currentVerLink)
+
+	err := os.Remove(stagedSymlinkPath)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove stale staged symlink")
+	}
+
+	err = os.Symlink(agentVersion, stagedSymlinkPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to create staged symlink")
+	}
+
+	err = os.Rename(stagedSymlinkPath, currentSymlinkPath)
+	if err != nil {
+		_ = os.Remove(stagedSymlinkPath)
+		return errors.Wrap(err, "failed to replace current version symlink")
+	}
+
+	return syncDir(agentBasePath)
+}
+
+// repairAgentInstalls removes any remnants of agent installations that were interrupted, such as
+// by the Envoy getting killed. It also removes the current version symlink if it no longer
+// points at an installed version.
+func repairAgentInstalls(agentBasePath string) {
+	entries, err := ioutil.ReadDir(agentBasePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", agentBasePath).Warn("unable to check agent installs")
+		}
+		return
+	}
+
+	for _, entry := range entries {
+		entryPath := path.Join(agentBasePath, entry.Name())
+
+		if strings.HasPrefix(entry.Name(), stagingPrefix) {
+			log.WithField("path", entryPath).Info("removing interrupted agent staging content")
+			err := os.RemoveAll(entryPath)
+			if err != nil {
+				log.WithError(err).WithField("path", entryPath).Warn("failed to remove staging content")
+			}
+		} else if entry.IsDir() && entry.Name() != configsDirSubpath && isPartialInstall(entryPath) {
+			log.WithField("path", entryPath).Warn("removing partially installed agent")
+			err := os.RemoveAll(entryPath)
+			if err != nil {
+				log.WithError(err).WithField("path", entryPath).Warn("failed to remove partial install")
+			}
+		}
+	}
+
+	currentSymlinkPath := path.Join(agentBasePath, currentVerLink)
+	if _, err := os.Lstat(currentSymlinkPath); err == nil && !fileExists(currentSymlinkPath) {
+		log.WithField("path", currentSymlinkPath).Warn("removing current version link to missing install")
+		err := os.Remove(currentSymlinkPath)
+		if err != nil {
+			log.WithError(err).WithField("path", currentSymlinkPath).Warn("failed to remove current version link")
+		}
+	}
+}
+
+// isPartialInstall identifies version directories that were left behind by an install that didn't
+// complete, which is either an empty directory or one without an executable in its bin directory.
+func isPartialInstall(versionPath string) bool {
+	entries, err := ioutil.ReadDir(versionPath)
+	if err != nil {
+		log.WithError(err).WithField("path", versionPath).Warn("unable to read directory")
+		return false
+	}
+	if len(entries) == 0 {
+		return true
+	}
+
+	binEntries, err := ioutil.ReadDir(path.Join(versionPath, binSubpath))
+	if err != nil {
+		// not an agent version directory
+		return false
+	}
+	for _, binEntry := range binEntries {
+		// stat follows the executable's link into the package for full extractions
+		info, err := os.Stat(path.Join(versionPath, binSubpath, binEntry.Name()))
+		if err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,475 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+type testPackageEntry struct {
+	name     string
+	content  string
+	linkname string
+	typeflag byte
+}
+
+func buildTarGz(t *testing.T, entries []testPackageEntry) []byte {
+	var buf bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buf)
+	writeTar(t, gzipWriter, entries)
+	require.NoError(t, gzipWriter.Close())
+	return buf.Bytes()
+}
+
+func buildTarXz(t *testing.T, entries []testPackageEntry) []byte {
+	var buf bytes.Buffer
+	xzWriter, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	writeTar(t, xzWriter, entries)
+	require.NoError(t, xzWriter.Close())
+	return buf.Bytes()
+}
+
+func writeTar(t *testing.T, w io.Writer, entries []testPackageEntry) {
+	tarWriter := tar.NewWriter(w)
+
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0755,
+			Size:     int64(len(entry.content)),
+		}
+		if entry.typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		require.NoError(t, tarWriter.WriteHeader(header))
+		if header.Size > 0 {
+			_, err := tarWriter.Write([]byte(entry.content))
+			require.NoError(t, err)
+		}
+	}
+
+	require.NoError(t, tarWriter.Close())
+}
+
+func buildZip(t *testing.T, entries []testPackageEntry) []byte {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+
+	for _, entry := range entries {
+		header := &zip.FileHeader{
+			Name:   entry.name,
+			Method: zip.Deflate,
+		}
+		content := entry.content
+		switch entry.typeflag {
+		case tar.TypeDir:
+			header.SetMode(os.ModeDir | 0755)
+		case tar.TypeSymlink:
+			header.SetMode(os.ModeSymlink | 0777)
+			content = entry.linkname
+		default:
+			header.SetMode(0755)
+		}
+		w, err := zipWriter.CreateHeader(header)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, zipWriter.Close())
+	return buf.Bytes()
+}
+
+// installTestPackage runs an install instruction for the given package content and returns the
+// path of the installed version, which won't exist if the install was rejected
+func installTestPackage(t *testing.T, dataPath string, agentType telemetry_edge.AgentType,
+	pkg []byte, exe string, mode telemetry_edge.EnvoyInstructionInstall_ExtractMode) string {
+	return installTestPackageWithFormat(t, dataPath, agentType, pkg, exe, mode,
+		telemetry_edge.EnvoyInstructionInstall_DETECT)
+}
+
+func installTestPackageWithFormat(t *testing.T, dataPath string, agentType telemetry_edge.AgentType,
+	pkg []byte, exe string, mode telemetry_edge.EnvoyInstructionInstall_ExtractMode,
+	format telemetry_edge.EnvoyInstructionInstall_PackageFormat) string {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(pkg)
+	}))
+	defer ts.Close()
+
+	agents.UnregisterAllAgentRunners()
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	agentsRunner, err := agents.NewAgentsRunner()
+	require.NoError(t, err)
+	agents.RegisterAgentRunnerForTesting(agentType, NewMockSpecificAgentRunner())
+
+	sum := sha256.Sum256(pkg)
+	agentsRunner.ProcessInstall(&telemetry_edge.EnvoyInstructionInstall{
+		Url: ts.URL + "/package",
+		Exe: exe,
+		Agent: &telemetry_edge.Agent{
+			Version: "1.0.0",
+			Type:    agentType,
+		},
+		Checksum: &telemetry_edge.Checksum{
+			Type:  telemetry_edge.Checksum_SHA256,
+			Value: hex.EncodeToString(sum[:]),
+		},
+		ExtractMode:   mode,
+		PackageFormat: format,
+	})
+
+	return path.Join(dataPath, "agents", agentType.String(), "1.0.0")
+}
+
+func TestProcessInstall_FullExtract(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	pkg := buildTarGz(t, []testPackageEntry{
+		{name: "filebeat-6.4.1/", typeflag: tar.TypeDir},
+		{name: "filebeat-6.4.1/filebeat", content: "#!/bin/sh\n"},
+		{name: "filebeat-6.4.1/fields.yml", content: "fields"},
+		{name: "filebeat-6.4.1/module/system/config.yml", content: "system"},
+		{name: "filebeat-6.4.1/module/default", linkname: "system", typeflag: tar.TypeSymlink},
+		{name: "filebeat-6.4.1/fields-copy.yml", linkname: "filebeat-6.4.1/fields.yml", typeflag: tar.TypeLink},
+	})
+
+	// filebeat defaults to full extraction
+	versionPath := installTestPackage(t, dataPath, telemetry_edge.AgentType_FILEBEAT,
+		pkg, "filebeat-6.4.1/filebeat", telemetry_edge.EnvoyInstructionInstall_AGENT_DEFAULT)
+
+	resolvedExe, err := filepath.EvalSymlinks(path.Join(versionPath, "bin", "filebeat"))
+	require.NoError(t, err)
+	assert.Equal(t, "filebeat-6.4.1", filepath.Base(filepath.Dir(resolvedExe)))
+
+	assert.FileExists(t, path.Join(versionPath, "pkg", "filebeat-6.4.1", "fields.yml"))
+	assert.FileExists(t, path.Join(versionPath, "pkg", "filebeat-6.4.1", "fields-copy.yml"))
+	assert.FileExists(t, path.Join(versionPath, "pkg", "filebeat-6.4.1", "module", "default", "config.yml"))
+}
+
+func TestProcessInstall_ExeOnlyOverride(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	pkg := buildTarGz(t, []testPackageEntry{
+		{name: "filebeat-6.4.1/filebeat", content: "#!/bin/sh\n"},
+		{name: "filebeat-6.4.1/fields.yml", content: "fields"},
+	})
+
+	versionPath := installTestPackage(t, dataPath, telemetry_edge.AgentType_FILEBEAT,
+		pkg, "filebeat-6.4.1/filebeat", telemetry_edge.EnvoyInstructionInstall_EXE_ONLY)
+
+	info, err := os.Lstat(path.Join(versionPath, "bin", "filebeat"))
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+
+	_, err = os.Stat(path.Join(versionPath, "pkg"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestProcessInstall_FullExtract_Unsafe(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []testPackageEntry
+	}{
+		{
+			name: "dotdot",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/../../../escaped", content: "bad"},
+			},
+		},
+		{
+			name: "absolute",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "/tmp/escaped", content: "bad"},
+			},
+		},
+		{
+			name: "symlinkOutside",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/etc", linkname: "../../../../etc", typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "symlinkAbsolute",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/etc", linkname: "/etc", typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "throughSymlink",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/deep/up", linkname: "../..", typeflag: tar.TypeSymlink},
+				{name: "agent/deep/up/../escaped", content: "bad"},
+				{name: "agent/deep/up/escaped", content: "bad"},
+			},
+		},
+		{
+			name: "chainedSymlinks",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/a0", linkname: "..", typeflag: tar.TypeSymlink},
+				{name: "agent/a1", linkname: "a0/..", typeflag: tar.TypeSymlink},
+				{name: "agent/a2", linkname: "a1/..", typeflag: tar.TypeSymlink},
+				{name: "agent/a3", linkname: "a2/..", typeflag: tar.TypeSymlink},
+				{name: "agent/shadow", linkname: "a3/etc/shadow", typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "symlinkThroughLaterSymlink",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/sub/etc", linkname: "up/../../../etc", typeflag: tar.TypeSymlink},
+				{name: "agent/sub/up", linkname: "..", typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "symlinkLoop",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/loop", linkname: "loop", typeflag: tar.TypeSymlink},
+				{name: "agent/via", linkname: "loop/x", typeflag: tar.TypeSymlink},
+			},
+		},
+		{
+			name: "hardLinkOutside",
+			entries: []testPackageEntry{
+				{name: "agent/agent", content: "exe"},
+				{name: "agent/passwd", linkname: "../../../../etc/passwd", typeflag: tar.TypeLink},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pegomock.RegisterMockTestingT(t)
+
+			dataPath, err := ioutil.TempDir("", "test_agents")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataPath)
+
+			versionPath := installTestPackage(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+				buildTarGz(t, tt.entries), "agent/agent", telemetry_edge.EnvoyInstructionInstall_FULL)
+
+			_, err = os.Stat(versionPath)
+			assert.True(t, os.IsNotExist(err), "install should have been rejected")
+
+			_, err = os.Lstat(path.Join(dataPath, "agents", "escaped"))
+			assert.True(t, os.IsNotExist(err), "should not have escaped")
+		})
+	}
+}
+
+func TestProcessInstall_PackageFormats(t *testing.T) {
+	entries := []testPackageEntry{
+		{name: "agent-1.0/", typeflag: tar.TypeDir},
+		{name: "agent-1.0/agent", content: "#!/bin/sh\n"},
+		{name: "agent-1.0/lib/data.txt", content: "data"},
+		{name: "agent-1.0/current", linkname: "lib", typeflag: tar.TypeSymlink},
+	}
+
+	tests := []struct {
+		name   string
+		pkg    []byte
+		format telemetry_edge.EnvoyInstructionInstall_PackageFormat
+	}{
+		{name: "tarGz", pkg: buildTarGz(t, entries)},
+		{name: "tarXz", pkg: buildTarXz(t, entries)},
+		{name: "zip", pkg: buildZip(t, entries)},
+		{name: "explicitZip", pkg: buildZip(t, entries), format: telemetry_edge.EnvoyInstructionInstall_ZIP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []telemetry_edge.EnvoyInstructionInstall_ExtractMode{
+				telemetry_edge.EnvoyInstructionInstall_EXE_ONLY,
+				telemetry_edge.EnvoyInstructionInstall_FULL,
+			} {
+				t.Run(mode.String(), func(t *testing.T) {
+					pegomock.RegisterMockTestingT(t)
+
+					dataPath, err := ioutil.TempDir("", "test_agents")
+					require.NoError(t, err)
+					defer os.RemoveAll(dataPath)
+
+					versionPath := installTestPackageWithFormat(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+						tt.pkg, "agent-1.0/agent", mode, tt.format)
+
+					content, err := ioutil.ReadFile(path.Join(versionPath, "bin", "agent"))
+					require.NoError(t, err)
+					assert.Equal(t, "#!/bin/sh\n", string(content))
+
+					if mode == telemetry_edge.EnvoyInstructionInstall_FULL {
+						assert.FileExists(t, path.Join(versionPath, "pkg", "agent-1.0", "current", "data.txt"))
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestProcessInstall_ZipWithoutUnixModes(t *testing.T) {
+	var buf bytes.Buffer
+	zipWriter := zip.NewWriter(&buf)
+	// without SetMode the entry only has MS-DOS attributes, which read back as 0666
+	w, err := zipWriter.CreateHeader(&zip.FileHeader{Name: "agent-1.0/agent", Method: zip.Deflate})
+	require.NoError(t, err)
+	_, err = w.Write([]byte("#!/bin/sh\n"))
+	require.NoError(t, err)
+	require.NoError(t, zipWriter.Close())
+
+	for _, mode := range []telemetry_edge.EnvoyInstructionInstall_ExtractMode{
+		telemetry_edge.EnvoyInstructionInstall_EXE_ONLY,
+		telemetry_edge.EnvoyInstructionInstall_FULL,
+	} {
+		t.Run(mode.String(), func(t *testing.T) {
+			pegomock.RegisterMockTestingT(t)
+
+			dataPath, err := ioutil.TempDir("", "test_agents")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataPath)
+
+			versionPath := installTestPackage(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+				buf.Bytes(), "agent-1.0/agent", mode)
+
+			info, err := os.Stat(path.Join(versionPath, "bin", "agent"))
+			require.NoError(t, err)
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm()&0755)
+		})
+	}
+}
+
+func TestProcessInstall_Binary(t *testing.T) {
+	tests := []struct {
+		name   string
+		format telemetry_edge.EnvoyInstructionInstall_PackageFormat
+		mode   telemetry_edge.EnvoyInstructionInstall_ExtractMode
+	}{
+		{name: "detect", format: telemetry_edge.EnvoyInstructionInstall_DETECT},
+		{name: "explicit", format: telemetry_edge.EnvoyInstructionInstall_BINARY},
+		{name: "full", format: telemetry_edge.EnvoyInstructionInstall_BINARY, mode: telemetry_edge.EnvoyInstructionInstall_FULL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pegomock.RegisterMockTestingT(t)
+
+			dataPath, err := ioutil.TempDir("", "test_agents")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataPath)
+
+			versionPath := installTestPackageWithFormat(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+				[]byte("\x7fELF-not-really"), "telegraf", tt.mode, tt.format)
+
+			exePath := path.Join(versionPath, "bin", "telegraf")
+			info, err := os.Lstat(exePath)
+			require.NoError(t, err)
+			assert.True(t, info.Mode().IsRegular())
+			assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+
+			content, err := ioutil.ReadFile(exePath)
+			require.NoError(t, err)
+			assert.Equal(t, "\x7fELF-not-really", string(content))
+		})
+	}
+}
+
+func TestProcessInstall_WrongFormat(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	pkg := buildZip(t, []testPackageEntry{
+		{name: "agent/agent", content: "exe"},
+	})
+	versionPath := installTestPackageWithFormat(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+		pkg, "agent/agent", telemetry_edge.EnvoyInstructionInstall_EXE_ONLY,
+		telemetry_edge.EnvoyInstructionInstall_TAR_GZ)
+
+	_, err = os.Stat(versionPath)
+	assert.True(t, os.IsNotExist(err), "install should have been rejected")
+}
+
+func TestProcessInstall_UndetectedFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "html", content: "<html><body>Not Found</body></html>"},
+		{name: "text", content: "exe"},
+		{name: "empty", content: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pegomock.RegisterMockTestingT(t)
+
+			dataPath, err := ioutil.TempDir("", "test_agents")
+			require.NoError(t, err)
+			defer os.RemoveAll(dataPath)
+
+			versionPath := installTestPackageWithFormat(t, dataPath, telemetry_edge.AgentType_TELEGRAF,
+				[]byte(tt.content), "telegraf", telemetry_edge.EnvoyInstructionInstall_AGENT_DEFAULT,
+				telemetry_edge.EnvoyInstructionInstall_DETECT)
+
+			_, err = os.Stat(versionPath)
+			assert.True(t, os.IsNotExist(err), "install should have been rejected")
+		})
+	}
+}
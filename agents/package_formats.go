@@ -0,0 +1,210 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zipMagic      = []byte("PK\x03\x04")
+	zipEmptyMagic = []byte("PK\x05\x06")
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	// executableMagics identify ELF, Mach-O (32-bit, 64-bit, and universal), PE, and script executables
+	executableMagics = [][]byte{
+		[]byte("\x7fELF"),
+		{0xfe, 0xed, 0xfa, 0xce}, {0xce, 0xfa, 0xed, 0xfe},
+		{0xfe, 0xed, 0xfa, 0xcf}, {0xcf, 0xfa, 0xed, 0xfe},
+		{0xca, 0xfe, 0xba, 0xbe},
+		[]byte("MZ"),
+		[]byte("#!"),
+	}
+)
+
+// extractPackage processes the downloaded agent package according to the given format, where
+// DETECT will sniff the format from the package content
+func extractPackage(pkgFile *os.File, format telemetry_edge.EnvoyInstructionInstall_PackageFormat,
+	extractor *packageExtractor) error {
+
+	if format == telemetry_edge.EnvoyInstructionInstall_DETECT {
+		var err error
+		format, err = detectPackageFormat(pkgFile)
+		if err != nil {
+			return err
+		}
+		log.WithField("format", format).Debug("detected agent package format")
+	}
+
+	switch format {
+	case telemetry_edge.EnvoyInstructionInstall_TAR_GZ:
+		gzipReader, err := gzip.NewReader(pkgFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to ungzip agent download")
+		}
+		return extractTar(gzipReader, extractor)
+
+	case telemetry_edge.EnvoyInstructionInstall_TAR_XZ:
+		xzReader, err := xz.NewReader(pkgFile)
+		if err != nil {
+			return errors.Wrap(err, "unable to unxz agent download")
+		}
+		return extractTar(xzReader, extractor)
+
+	case telemetry_edge.EnvoyInstructionInstall_ZIP:
+		return extractZip(pkgFile, extractor)
+
+	case telemetry_edge.EnvoyInstructionInstall_BINARY:
+		return extractBinary(pkgFile, extractor)
+
+	default:
+		return errors.Errorf("unsupported package format: %v", format)
+	}
+}
+
+// detectPackageFormat sniffs the leading bytes of the package and leaves the file positioned at the start
+func detectPackageFormat(pkgFile *os.File) (telemetry_edge.EnvoyInstructionInstall_PackageFormat, error) {
+	header := make([]byte, len(xzMagic))
+	n, err := io.ReadFull(pkgFile, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, errors.Wrap(err, "unable to read agent package header")
+	}
+	header = header[:n]
+
+	_, err = pkgFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to rewind agent download")
+	}
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return telemetry_edge.EnvoyInstructionInstall_TAR_GZ, nil
+	case bytes.HasPrefix(header, zipMagic), bytes.HasPrefix(header, zipEmptyMagic):
+		return telemetry_edge.EnvoyInstructionInstall_ZIP, nil
+	case bytes.HasPrefix(header, xzMagic):
+		return telemetry_edge.EnvoyInstructionInstall_TAR_XZ, nil
+	case isExecutable(header):
+		return telemetry_edge.EnvoyInstructionInstall_BINARY, nil
+	default:
+		// such as an error page served in place of the package
+		return 0, errors.New("unable to detect the format of the agent package")
+	}
+}
+
+func isExecutable(header []byte) bool {
+	for _, magic := range executableMagics {
+		if bytes.HasPrefix(header, magic) {
+			return true
+		}
+	}
+	return false
+}
+
+func extractTar(reader io.Reader, extractor *packageExtractor) error {
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "failed to read agent package")
+		}
+
+		entry := &packageEntry{
+			name:     header.Name,
+			mode:     header.FileInfo().Mode(),
+			linkname: header.Linkname,
+			content:  tarReader,
+		}
+		if header.Typeflag == tar.TypeLink {
+			entry.hardLink = true
+		}
+
+		err = extractor.handleEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return extractor.finish()
+}
+
+func extractZip(pkgFile *os.File, extractor *packageExtractor) error {
+	info, err := pkgFile.Stat()
+	if err != nil {
+		return errors.Wrap(err, "unable to stat agent download")
+	}
+
+	zipReader, err := zip.NewReader(pkgFile, info.Size())
+	if err != nil {
+		return errors.Wrap(err, "unable to unzip agent download")
+	}
+
+	for _, file := range zipReader.File {
+		err := extractZipEntry(file, extractor)
+		if err != nil {
+			return err
+		}
+	}
+
+	return extractor.finish()
+}
+
+func extractZipEntry(file *zip.File, extractor *packageExtractor) error {
+	content, err := file.Open()
+	if err != nil {
+		return errors.Wrapf(err, "unable to open package entry %s", file.Name)
+	}
+	//noinspection GoUnhandledErrorResult
+	defer content.Close()
+
+	entry := &packageEntry{
+		name:    file.Name,
+		mode:    file.Mode(),
+		content: content,
+	}
+	if entry.mode&os.ModeSymlink != 0 {
+		// zip stores the target of a symlink as the entry's content
+		linkname, err := ioutil.ReadAll(content)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read symlink entry %s", file.Name)
+		}
+		entry.linkname = string(linkname)
+	}
+
+	return extractor.handleEntry(entry)
+}
+
+// extractBinary handles a package that is the agent's executable itself
+func extractBinary(pkgFile *os.File, extractor *packageExtractor) error {
+	err := extractor.handleExecutable(pkgFile)
+	if err != nil {
+		return err
+	}
+
+	return extractor.finish()
+}
@@ -0,0 +1,156 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"github.com/golang/protobuf/proto"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"sort"
+)
+
+// ProcessRefresh converges the agents to the complete desired state conveyed by the refresh. The
+// acks of the installs and configuration operations that were needed are returned.
+func (ar *StandardAgentsRouter) ProcessRefresh(refresh *telemetry_edge.EnvoyInstructionRefresh) []*telemetry_edge.InstructionAck {
+	if len(refresh.GetAgents()) == 0 {
+		log.Debug("refresh without desired state only confirms liveness")
+		return nil
+	}
+
+	log.WithField("agents", len(refresh.GetAgents())).Info("processing refresh instruction")
+
+	ar.Lock()
+	defer ar.Unlock()
+
+	desiredStates := make(map[telemetry_edge.AgentType]*telemetry_edge.AgentDesiredState)
+	for _, desired := range refresh.GetAgents() {
+		desiredStates[desired.GetAgentType()] = desired
+	}
+
+	var acks []*telemetry_edge.InstructionAck
+	for agentType, specificRunner := range specificAgentRunners {
+		desired, exists := desiredStates[agentType]
+		if !exists {
+			// the agent is no longer wanted at all
+			if configure := ar.configsToConverge(agentType, nil); configure != nil {
+				acks = append(acks, configureInstructionAck(ar.processConfigure(configure)))
+			}
+			if specificRunner.IsRunning() {
+				log.WithField("type", agentType).Info("stopping agent that is no longer desired")
+				specificRunner.Stop()
+			}
+			continue
+		}
+
+		if install := desired.GetInstall(); install != nil {
+			agentBasePath := path.Join(ar.DataPath, agentsSubpath, agentType.String())
+			if currentVersion(agentBasePath) != install.GetAgent().GetVersion() {
+				acks = append(acks, &telemetry_edge.InstructionAck{
+					Details: &telemetry_edge.InstructionAck_Install{Install: ar.installAck(install)},
+				})
+			}
+		}
+
+		if configure := ar.configsToConverge(agentType, desired.GetConfigs()); configure != nil {
+			acks = append(acks, configureInstructionAck(ar.processConfigure(configure)))
+		}
+	}
+
+	for agentType := range desiredStates {
+		if _, exists := specificAgentRunners[agentType]; !exists {
+			log.WithField("type", agentType).Warn("unable to refresh unknown agent type")
+		}
+	}
+
+	return acks
+}
+
+// configsToConverge determines the configuration operations that bring the applied configs of an
+// agent to the desired configs. Configs found in the agent's configs directory that are not desired
+// are removed too, even if they're not recorded as applied. Returns nil if the applied configs are
+// already as desired.
+func (ar *StandardAgentsRouter) configsToConverge(agentType telemetry_edge.AgentType,
+	desiredConfigs []*telemetry_edge.ConfigurationOp) *telemetry_edge.EnvoyInstructionConfigure {
+
+	state := ar.appliedConfigsOf(agentType)
+	configure := &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: agentType,
+	}
+
+	desiredIds := make(map[string]struct{}, len(desiredConfigs))
+	for _, desired := range desiredConfigs {
+		desiredIds[desired.GetId()] = struct{}{}
+
+		applied, exists := state.Ops[desired.GetId()]
+		if exists && !applied.Removed {
+			// without revisions to compare, the config is re-applied to be sure it is current
+			if desired.GetRevision() != "" && applied.Revision != "" &&
+				compareRevisions(desired.GetRevision(), applied.Revision) <= 0 {
+				continue
+			}
+		}
+
+		op := proto.Clone(desired).(*telemetry_edge.ConfigurationOp)
+		op.Type = telemetry_edge.ConfigurationOp_CREATE
+		if exists && !applied.Removed {
+			op.Type = telemetry_edge.ConfigurationOp_MODIFY
+		}
+		configure.Operations = append(configure.Operations, op)
+	}
+
+	removedIds := make(map[string]struct{})
+	for id, applied := range state.Ops {
+		if _, exists := desiredIds[id]; !exists && !applied.Removed {
+			removedIds[id] = struct{}{}
+		}
+	}
+	// configs the state doesn't know about, such as those written before the state was recorded
+	configsPath := path.Join(ar.DataPath, agentsSubpath, agentType.String(), configsDirSubpath)
+	for _, id := range configIdsInDir(configsPath) {
+		if _, exists := desiredIds[id]; !exists {
+			removedIds[id] = struct{}{}
+		}
+	}
+
+	sortedRemovedIds := make([]string, 0, len(removedIds))
+	for id := range removedIds {
+		sortedRemovedIds = append(sortedRemovedIds, id)
+	}
+	sort.Strings(sortedRemovedIds)
+	for _, id := range sortedRemovedIds {
+		op := &telemetry_edge.ConfigurationOp{
+			Id:   id,
+			Type: telemetry_edge.ConfigurationOp_REMOVE,
+		}
+		if applied, exists := state.Ops[id]; exists {
+			op.Revision = applied.Revision
+		}
+		configure.Operations = append(configure.Operations, op)
+	}
+
+	if len(configure.Operations) == 0 {
+		return nil
+	}
+	return configure
+}
+
+func configureInstructionAck(ack *telemetry_edge.ConfigureAck) *telemetry_edge.InstructionAck {
+	return &telemetry_edge.InstructionAck{
+		Details: &telemetry_edge.InstructionAck_Configure{Configure: ack},
+	}
+}
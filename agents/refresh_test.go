@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/agents/matchers"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// stubSuccessfulProcessConfig has the mock runner acknowledge every operation as applied
+func stubSuccessfulProcessConfig(mockSpecificAgentRunner *MockSpecificAgentRunner) {
+	pegomock.When(mockSpecificAgentRunner.ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).
+		Then(func(params []pegomock.Param) pegomock.ReturnValues {
+			configure := params[0].(*telemetry_edge.EnvoyInstructionConfigure)
+			var acks []*telemetry_edge.ConfigurationOpAck
+			for _, op := range configure.GetOperations() {
+				acks = append(acks, &telemetry_edge.ConfigurationOpAck{Id: op.GetId(), Success: true})
+			}
+			return pegomock.ReturnValues{acks, nil}
+		})
+}
+
+func opSummaries(configure *telemetry_edge.EnvoyInstructionConfigure) []string {
+	var summaries []string
+	for _, op := range configure.GetOperations() {
+		summaries = append(summaries, op.GetType().String()+" "+op.GetId()+"@"+op.GetRevision())
+	}
+	return summaries
+}
+
+func TestAgentsRunner_ProcessRefresh_ConvergesConfigs(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	stubSuccessfulProcessConfig(mockSpecificAgentRunner)
+
+	agentsRunner.ProcessConfigure(&telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{Id: "a", Revision: "1"},
+			{Id: "b", Revision: "1"},
+			{Id: "d", Revision: "1"},
+		},
+	})
+
+	refresh := &telemetry_edge.EnvoyInstructionRefresh{
+		Agents: []*telemetry_edge.AgentDesiredState{
+			{
+				AgentType: telemetry_edge.AgentType_TELEGRAF,
+				Configs: []*telemetry_edge.ConfigurationOp{
+					{Id: "a", Revision: "1"},
+					{Id: "b", Revision: "2", Content: "changed"},
+					{Id: "c", Revision: "1", Content: "new"},
+				},
+			},
+		},
+	}
+	acks := agentsRunner.ProcessRefresh(refresh)
+	require.Len(t, acks, 1)
+	require.NotNil(t, acks[0].GetConfigure())
+	assert.Len(t, acks[0].GetConfigure().Operations, 3)
+
+	configures := mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure()).
+		GetAllCapturedArguments()
+	assert.Equal(t, []string{"MODIFY b@2", "CREATE c@1", "REMOVE d@1"}, opSummaries(configures[1]))
+	assert.Equal(t, "changed", configures[1].Operations[0].Content)
+
+	// already converged
+	acks = agentsRunner.ProcessRefresh(refresh)
+	assert.Empty(t, acks)
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())
+
+	// only a liveness check
+	acks = agentsRunner.ProcessRefresh(&telemetry_edge.EnvoyInstructionRefresh{})
+	assert.Empty(t, acks)
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Never()).Stop()
+}
+
+func TestAgentsRunner_ProcessRefresh_RemovesUnrecordedConfigs(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	stubSuccessfulProcessConfig(mockSpecificAgentRunner)
+
+	agentsRunner.ProcessConfigure(configureOp("a", "1"))
+	// such as a config whose applied state failed to save
+	configsPath := path.Join(dataPath, "agents", "TELEGRAF", "config.d")
+	require.NoError(t, os.MkdirAll(configsPath, 0755))
+	require.NoError(t, ioutil.WriteFile(path.Join(configsPath, "a.conf"), []byte("applied"), 0600))
+	require.NoError(t, ioutil.WriteFile(path.Join(configsPath, "stray.conf"), []byte("unknown"), 0600))
+
+	acks := agentsRunner.ProcessRefresh(&telemetry_edge.EnvoyInstructionRefresh{
+		Agents: []*telemetry_edge.AgentDesiredState{
+			{
+				AgentType: telemetry_edge.AgentType_TELEGRAF,
+				Configs: []*telemetry_edge.ConfigurationOp{
+					{Id: "a", Revision: "1"},
+				},
+			},
+		},
+	})
+	require.Len(t, acks, 1)
+
+	configures := mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure()).
+		GetAllCapturedArguments()
+	assert.Equal(t, []string{"REMOVE stray@"}, opSummaries(configures[1]))
+}
+
+func TestAgentsRunner_ProcessRefresh_StopsUndesiredAgent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupConfigStateTest(t, dataPath)
+	stubSuccessfulProcessConfig(mockSpecificAgentRunner)
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).ThenReturn(true)
+
+	agentsRunner.ProcessConfigure(configureOp("a", "3"))
+
+	acks := agentsRunner.ProcessRefresh(&telemetry_edge.EnvoyInstructionRefresh{
+		Agents: []*telemetry_edge.AgentDesiredState{
+			{AgentType: telemetry_edge.AgentType_FILEBEAT},
+		},
+	})
+	require.Len(t, acks, 1)
+
+	configures := mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure()).
+		GetAllCapturedArguments()
+	assert.Equal(t, []string{"REMOVE a@3"}, opSummaries(configures[1]))
+	mockSpecificAgentRunner.VerifyWasCalledOnce().Stop()
+}
+
+func TestAgentsRunner_ProcessRefresh_InstallsDesiredVersion(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, _ := setupVersionsTest(t, dataPath, "1.8.0")
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	refresh := &telemetry_edge.EnvoyInstructionRefresh{
+		Agents: []*telemetry_edge.AgentDesiredState{
+			{
+				AgentType: telemetry_edge.AgentType_TELEGRAF,
+				Install:   telegrafInstall(t, ts.URL, "1.9.0"),
+			},
+		},
+	}
+
+	acks := agentsRunner.ProcessRefresh(refresh)
+	require.Len(t, acks, 1)
+	require.NotNil(t, acks[0].GetInstall())
+	assert.True(t, acks[0].GetInstall().Success)
+	assertCurrentVersion(t, dataPath, "1.9.0")
+
+	acks = agentsRunner.ProcessRefresh(refresh)
+	assert.Empty(t, acks)
+}
@@ -84,37 +84,40 @@ func (tr *TelegrafRunner) SetCommandHandler(handler CommandHandler) {
 	tr.commandHandler = handler
 }
 
-func (tr *TelegrafRunner) ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) error {
+func (tr *TelegrafRunner) ProcessConfig(configure *telemetry_edge.EnvoyInstructionConfigure) ([]*telemetry_edge.ConfigurationOpAck, error) {
 	configsPath := path.Join(tr.basePath, configsDirSubpath)
 	err := os.MkdirAll(configsPath, dirPerms)
 	if err != nil {
-		return errors.Wrapf(err, "failed to create configs path for telegraf: %v", configsPath)
+		return nil, errors.Wrapf(err, "failed to create configs path for telegraf: %v", configsPath)
 	}
 
 	mainConfigPath := path.Join(tr.basePath, telegrafMainConfigFilename)
 	if !fileExists(mainConfigPath) {
 		err = tr.createMainConfig(mainConfigPath)
 		if err != nil {
-			return errors.Wrap(err, "failed to create main telegraf config")
+			return nil, errors.Wrap(err, "failed to create main telegraf config")
 		}
 	}
 
+	acks := make([]*telemetry_edge.ConfigurationOpAck, 0, len(configure.GetOperations()))
 	applied := 0
 	for _, op := range configure.GetOperations() {
 		log.WithField("op", op).Debug("processing telegraf config operation")
 
 		configInstancePath := filepath.Join(configsPath, fmt.Sprintf("%s.conf", op.GetId()))
 
-		if handleContentConfigurationOp(op, configInstancePath, ConversionJsonToTelegrafToml) {
+		err = handleContentConfigurationOp(op, configInstancePath, ConversionJsonToTelegrafToml)
+		if err == nil {
 			applied++
 		}
+		acks = append(acks, newConfigurationOpAck(op, err))
 	}
 
 	if applied == 0 {
-		return &noAppliedConfigsError{}
+		return acks, &noAppliedConfigsError{}
 	}
 
-	return nil
+	return acks, nil
 }
 
 func (tr *TelegrafRunner) EnsureRunningState(ctx context.Context, applyConfigs bool) {
@@ -166,6 +169,10 @@ func (tr *TelegrafRunner) Stop() {
 	tr.running = nil
 }
 
+func (tr *TelegrafRunner) IsRunning() bool {
+	return tr.running.IsRunning()
+}
+
 func (tr *TelegrafRunner) createMainConfig(mainConfigPath string) error {
 	file, err := os.OpenFile(mainConfigPath, os.O_CREATE|os.O_RDWR, configFilePerms)
 	if err != nil {
@@ -70,7 +70,7 @@ func TestTelegrafRunner_ProcessConfig_CreateModify(t *testing.T) {
 					},
 				},
 			}
-			err = runner.ProcessConfig(configure)
+			_, err = runner.ProcessConfig(configure)
 			require.NoError(t, err)
 
 			var files, mainConfigs, instanceConfigs int
@@ -104,6 +104,58 @@ func TestTelegrafRunner_ProcessConfig_CreateModify(t *testing.T) {
 	}
 }
 
+func TestTelegrafRunner_ProcessConfig_Acks(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "telegraf_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	runner := &agents.TelegrafRunner{}
+	viper.Set(config.IngestTelegrafJsonBind, "localhost:8094")
+	err = runner.Load(dataPath)
+	require.NoError(t, err)
+	runner.SetCommandHandler(NewMockCommandHandler())
+
+	configure := &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{
+				Id:       "good",
+				Revision: "1",
+				Type:     telemetry_edge.ConfigurationOp_CREATE,
+				Content:  "{\"type\":\"mem\"}",
+			},
+			{
+				Id:       "bad",
+				Revision: "2",
+				Type:     telemetry_edge.ConfigurationOp_CREATE,
+				Content:  "not json",
+			},
+		},
+	}
+	acks, err := runner.ProcessConfig(configure)
+	require.NoError(t, err)
+	require.Len(t, acks, 2)
+
+	assert.Equal(t, "good", acks[0].Id)
+	assert.Equal(t, "1", acks[0].Revision)
+	assert.True(t, acks[0].Success)
+	assert.Empty(t, acks[0].Error)
+
+	assert.Equal(t, "bad", acks[1].Id)
+	assert.Equal(t, "2", acks[1].Revision)
+	assert.False(t, acks[1].Success)
+	assert.Contains(t, acks[1].Error, "TOML")
+
+	// when nothing could be applied, the acks are still available
+	configure.Operations = configure.Operations[1:]
+	acks, err = runner.ProcessConfig(configure)
+	assert.True(t, agents.IsNoAppliedConfigs(err))
+	require.Len(t, acks, 1)
+	assert.False(t, acks[0].Success)
+}
+
 func TestTelegrafRunner_EnsureRunning_NoConfig(t *testing.T) {
 	pegomock.RegisterMockTestingT(t)
 
@@ -165,7 +217,7 @@ func TestTelegrafRunner_EnsureRunningState_FullSequence(t *testing.T) {
 			},
 		},
 	}
-	err = telegrafRunner.ProcessConfig(createConfig)
+	_, err = telegrafRunner.ProcessConfig(createConfig)
 	require.NoError(t, err)
 	configs, err := ioutil.ReadDir(path.Join(dataPath, "config.d"))
 	require.NoError(t, err)
@@ -207,7 +259,7 @@ func TestTelegrafRunner_EnsureRunningState_FullSequence(t *testing.T) {
 			},
 		},
 	}
-	err = telegrafRunner.ProcessConfig(modifyConfig)
+	_, err = telegrafRunner.ProcessConfig(modifyConfig)
 	require.NoError(t, err)
 	configs, err = ioutil.ReadDir(path.Join(dataPath, "config.d"))
 	require.NoError(t, err)
@@ -229,7 +281,7 @@ func TestTelegrafRunner_EnsureRunningState_FullSequence(t *testing.T) {
 			},
 		},
 	}
-	err = telegrafRunner.ProcessConfig(removeConfig)
+	_, err = telegrafRunner.ProcessConfig(removeConfig)
 	require.NoError(t, err)
 	configs, err = ioutil.ReadDir(path.Join(dataPath, "config.d"))
 	require.NoError(t, err)
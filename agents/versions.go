@@ -0,0 +1,206 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents
+
+import (
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	viper.SetDefault(config.AgentsRetainVersions, 3)
+}
+
+type installedVersion struct {
+	version     string
+	installedAt time.Time
+}
+
+// installedVersions lists the completely installed versions of an agent, most recently installed first
+func installedVersions(agentBasePath string) ([]installedVersion, error) {
+	entries, err := ioutil.ReadDir(agentBasePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "unable to read agent versions")
+	}
+
+	var versions []installedVersion
+	for _, entry := range entries {
+		versionPath := path.Join(agentBasePath, entry.Name())
+		if !entry.IsDir() ||
+			entry.Name() == configsDirSubpath ||
+			strings.HasPrefix(entry.Name(), stagingPrefix) ||
+			!isVersionDir(versionPath) ||
+			isPartialInstall(versionPath) {
+			continue
+		}
+
+		versions = append(versions, installedVersion{
+			version:     entry.Name(),
+			installedAt: installTimeOf(versionPath, entry),
+		})
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].installedAt.After(versions[j].installedAt)
+	})
+	return versions, nil
+}
+
+// isVersionDir distinguishes version directories from others in the agent's base path, such as
+// the data and logs directories of filebeat, which runs from there. Versions installed before the
+// install time was recorded are recognized by their bin directory.
+func isVersionDir(versionPath string) bool {
+	return fileExists(path.Join(versionPath, installedMarker)) ||
+		fileExists(path.Join(versionPath, binSubpath))
+}
+
+// installTimeOf reads the install time recorded in the version directory. Versions installed
+// before the time was recorded fall back to the directory's modification time.
+func installTimeOf(versionPath string, info os.FileInfo) time.Time {
+	content, err := ioutil.ReadFile(path.Join(versionPath, installedMarker))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", versionPath).Warn("unable to read agent install time")
+		}
+		return info.ModTime()
+	}
+
+	installedAt, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(content)))
+	if err != nil {
+		log.WithError(err).WithField("path", versionPath).Warn("unable to parse agent install time")
+		return info.ModTime()
+	}
+	return installedAt
+}
+
+// currentVersion returns the version the current version symlink points at or an empty string
+// if no version is current
+func currentVersion(agentBasePath string) string {
+	target, err := os.Readlink(path.Join(agentBasePath, currentVerLink))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", agentBasePath).Warn("unable to read current version link")
+		}
+		return ""
+	}
+	return filepath.Base(target)
+}
+
+// pruneAgentVersions removes the least recently installed versions of an agent, such that at most
+// retain versions remain. The current version is always retained. A retain value of zero or less
+// disables pruning.
+func pruneAgentVersions(agentBasePath string, retain int) {
+	if retain <= 0 {
+		return
+	}
+
+	versions, err := installedVersions(agentBasePath)
+	if err != nil {
+		log.WithError(err).WithField("path", agentBasePath).Warn("unable to prune agent versions")
+		return
+	}
+
+	current := currentVersion(agentBasePath)
+	kept := 0
+	for _, v := range versions {
+		if v.version == current {
+			kept++
+		}
+	}
+
+	for _, v := range versions {
+		if v.version == current {
+			continue
+		}
+		if kept < retain {
+			kept++
+			continue
+		}
+
+		versionPath := path.Join(agentBasePath, v.version)
+		log.WithField("path", versionPath).Info("pruning old agent version")
+		err := os.RemoveAll(versionPath)
+		if err != nil {
+			log.WithError(err).WithField("path", versionPath).Warn("failed to prune agent version")
+		}
+	}
+}
+
+// RollbackAgent points the given agent type at a previously installed version, which is the version
+// installed before the current one when version is empty. The version that is now current is
+// returned. A running Envoy needs to restart the agent for it to take effect.
+func RollbackAgent(dataPath string, agentType telemetry_edge.AgentType, version string) (string, error) {
+	return rollbackAgentVersion(path.Join(dataPath, agentsSubpath, agentType.String()), version)
+}
+
+func rollbackAgentVersion(agentBasePath string, version string) (string, error) {
+	versions, err := installedVersions(agentBasePath)
+	if err != nil {
+		return "", err
+	}
+	current := currentVersion(agentBasePath)
+
+	target := ""
+	if version != "" {
+		for _, v := range versions {
+			if v.version == version {
+				target = version
+				break
+			}
+		}
+		if target == "" {
+			return "", errors.Errorf("version %s is not installed", version)
+		}
+	} else {
+		if current == "" {
+			return "", errors.New("no current version to roll back from")
+		}
+		// versions are ordered most recent first, so the previous install follows the current one
+		for i, v := range versions {
+			if v.version == current && i+1 < len(versions) {
+				target = versions[i+1].version
+				break
+			}
+		}
+		if target == "" {
+			return "", errors.Errorf("no version installed prior to %s is available", current)
+		}
+	}
+
+	if target == current {
+		return target, nil
+	}
+
+	err = switchCurrentVersion(agentBasePath, target)
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
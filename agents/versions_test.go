@@ -0,0 +1,396 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package agents_test
+
+import (
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/agents/matchers"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// setupVersionsTest creates an agents runner with a mock telegraf runner and installs each of
+// the given versions of telegraf, in order
+func setupVersionsTest(t *testing.T, dataPath string, versions ...string) (agents.Router, *MockSpecificAgentRunner) {
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+
+	agents.UnregisterAllAgentRunners()
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	agentsRunner, err := agents.NewAgentsRunner()
+	require.NoError(t, err)
+
+	mockSpecificAgentRunner := NewMockSpecificAgentRunner()
+	agents.RegisterAgentRunnerForTesting(telemetry_edge.AgentType_TELEGRAF, mockSpecificAgentRunner)
+
+	for _, version := range versions {
+		agentsRunner.ProcessInstall(telegrafInstall(t, ts.URL, version))
+	}
+
+	return agentsRunner, mockSpecificAgentRunner
+}
+
+func telegrafInstall(t *testing.T, url string, version string) *telemetry_edge.EnvoyInstructionInstall {
+	return &telemetry_edge.EnvoyInstructionInstall{
+		Url: url + "/telegraf_dot_slash.tgz",
+		Exe: "./telegraf/usr/bin/telegraf",
+		Agent: &telemetry_edge.Agent{
+			Version: version,
+			Type:    telemetry_edge.AgentType_TELEGRAF,
+		},
+		Checksum: &telemetry_edge.Checksum{
+			Type:  telemetry_edge.Checksum_SHA256,
+			Value: sha256File(t, path.Join("testdata", "telegraf_dot_slash.tgz")),
+		},
+	}
+}
+
+func assertCurrentVersion(t *testing.T, dataPath string, expected string) {
+	target, err := os.Readlink(path.Join(dataPath, "agents", "TELEGRAF", "CURRENT"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, target)
+}
+
+func TestAgentsRunner_ProcessInstall_PrunesVersions(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsRetainVersions, 2)
+	defer viper.Set(config.AgentsRetainVersions, 3)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	setupVersionsTest(t, dataPath, "1.7.0", "1.8.0", "1.9.0")
+
+	assertCurrentVersion(t, dataPath, "1.9.0")
+	_, err = os.Stat(path.Join(dataPath, "agents", "TELEGRAF", "1.7.0"))
+	assert.True(t, os.IsNotExist(err), "oldest version should have been pruned")
+	assert.DirExists(t, path.Join(dataPath, "agents", "TELEGRAF", "1.8.0"))
+	assert.DirExists(t, path.Join(dataPath, "agents", "TELEGRAF", "1.9.0"))
+}
+
+func TestAgentsRunner_ProcessInstall_PruneKeepsCurrent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsRetainVersions, 1)
+	defer viper.Set(config.AgentsRetainVersions, 3)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	setupVersionsTest(t, dataPath, "1.8.0", "1.9.0")
+
+	assertCurrentVersion(t, dataPath, "1.9.0")
+	_, err = os.Stat(path.Join(dataPath, "agents", "TELEGRAF", "1.8.0"))
+	assert.True(t, os.IsNotExist(err), "previous version should have been pruned")
+}
+
+func TestAgentsRunner_ProcessInstall_SwitchesToRetainedVersion(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Millisecond)
+	defer viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Second)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0", "1.9.0")
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).ThenReturn(true)
+
+	// the download should not be needed
+	agentsRunner.ProcessInstall(telegrafInstall(t, "http://localhost:0", "1.8.0"))
+
+	assertCurrentVersion(t, dataPath, "1.8.0")
+	mockSpecificAgentRunner.VerifyWasCalledOnce().Stop()
+}
+
+func TestAgentsRunner_ProcessRollback(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0", "1.9.0")
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+
+	agentsRunner.ProcessRollback(&telemetry_edge.EnvoyInstructionRollback{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF},
+	})
+	assertCurrentVersion(t, dataPath, "1.8.0")
+	mockSpecificAgentRunner.VerifyWasCalledOnce().Stop()
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(3)).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+
+	// nothing was installed prior to 1.8.0
+	agentsRunner.ProcessRollback(&telemetry_edge.EnvoyInstructionRollback{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF},
+	})
+	assertCurrentVersion(t, dataPath, "1.8.0")
+	mockSpecificAgentRunner.VerifyWasCalledOnce().Stop()
+
+	agentsRunner.ProcessRollback(&telemetry_edge.EnvoyInstructionRollback{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.7.0"},
+	})
+	assertCurrentVersion(t, dataPath, "1.8.0")
+
+	agentsRunner.ProcessRollback(&telemetry_edge.EnvoyInstructionRollback{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+	})
+	assertCurrentVersion(t, dataPath, "1.9.0")
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).Stop()
+}
+
+func TestRollbackAgent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	setupVersionsTest(t, dataPath, "1.7.0", "1.8.0", "1.9.0")
+
+	version, err := agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.0", version)
+
+	version, err = agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.7.0", version)
+	assertCurrentVersion(t, dataPath, "1.7.0")
+
+	_, err = agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	assert.Error(t, err)
+
+	_, err = agents.RollbackAgent(dataPath, telemetry_edge.AgentType_FILEBEAT, "")
+	assert.Error(t, err)
+}
+
+func TestRollbackAgent_OrdersByInstallTime(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	setupVersionsTest(t, dataPath, "1.8.0", "1.9.0")
+
+	// touching an older version's directory must not make it appear more recently installed
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(path.Join(dataPath, "agents", "TELEGRAF", "1.8.0"), later, later)
+	require.NoError(t, err)
+
+	version, err := agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.8.0", version)
+}
+
+func TestAgentVersions_IgnoreAgentDataDirectories(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsRetainVersions, 2)
+	defer viper.Set(config.AgentsRetainVersions, 3)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	setupVersionsTest(t, dataPath, "1.8.0")
+
+	// such as filebeat creates when running from the agent's base path
+	basePath := path.Join(dataPath, "agents", "TELEGRAF")
+	registryPath := path.Join(basePath, "data", "registry", "filebeat", "data.json")
+	require.NoError(t, os.MkdirAll(path.Dir(registryPath), 0755))
+	require.NoError(t, ioutil.WriteFile(registryPath, []byte("[]"), 0644))
+	require.NoError(t, os.Mkdir(path.Join(basePath, "logs"), 0755))
+	earlier := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(path.Join(basePath, "data"), earlier, earlier))
+	require.NoError(t, os.Chtimes(path.Join(basePath, "logs"), earlier, earlier))
+
+	setupVersionsTest(t, dataPath, "1.9.0", "2.0.0")
+
+	_, err = os.Stat(path.Join(basePath, "1.8.0"))
+	assert.True(t, os.IsNotExist(err), "oldest version should have been pruned")
+	assert.FileExists(t, registryPath)
+	assert.DirExists(t, path.Join(basePath, "logs"))
+
+	version, err := agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	require.NoError(t, err)
+	assert.Equal(t, "1.9.0", version)
+
+	_, err = agents.RollbackAgent(dataPath, telemetry_edge.AgentType_TELEGRAF, "")
+	assert.Error(t, err)
+	assertCurrentVersion(t, dataPath, "1.9.0")
+}
+
+func TestAgentsRunner_ProcessInstall_RestartsRunningAgent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsUpgradeGracePeriod, 50*time.Millisecond)
+	defer viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Second)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0")
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Never()).Stop()
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).ThenReturn(true)
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	ack := agentsRunner.ProcessInstall(telegrafInstall(t, ts.URL, "1.9.0"))
+
+	assert.True(t, ack.Success)
+	assertCurrentVersion(t, dataPath, "1.9.0")
+	mockSpecificAgentRunner.VerifyWasCalledOnce().Stop()
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+}
+
+func TestAgentsRunner_ProcessInstall_RevertsUnhealthyUpgrade(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsUpgradeGracePeriod, 1*time.Second)
+	defer viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Second)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0")
+	// running prior to the upgrade, then it fails to start
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).
+		ThenReturn(true).
+		ThenReturn(false)
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	ack := agentsRunner.ProcessInstall(telegrafInstall(t, ts.URL, "1.9.0"))
+
+	assert.False(t, ack.Success)
+	assert.Equal(t, "1.9.0", ack.Agent.Version)
+	assert.Contains(t, ack.Error, "reverted to version 1.8.0")
+	assertCurrentVersion(t, dataPath, "1.8.0")
+	_, err = os.Stat(path.Join(dataPath, "agents", "TELEGRAF", "1.9.0"))
+	assert.True(t, os.IsNotExist(err), "failed version should have been removed")
+	// once to upgrade and again to revert
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(2)).Stop()
+	mockSpecificAgentRunner.VerifyWasCalled(pegomock.Times(3)).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+}
+
+func TestAgentsRunner_ProcessInstall_RevertsUpgradeThatExits(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsUpgradeGracePeriod, 1*time.Minute)
+	defer viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Second)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0")
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).ThenReturn(true)
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	ack := agentsRunner.ProcessInstall(telegrafInstall(t, ts.URL, "1.9.0"))
+
+	// the install is acknowledged without waiting out the grace period
+	assert.True(t, ack.Success)
+	assertCurrentVersion(t, dataPath, "1.9.0")
+
+	// then the upgraded agent exits
+	runFailingAgent(t, agents.CommandHandlerOf(agentsRunner), mockSpecificAgentRunner)
+
+	// once to upgrade and again to revert
+	mockSpecificAgentRunner.VerifyWasCalledEventually(pegomock.Times(2), 1*time.Second).Stop()
+	mockSpecificAgentRunner.VerifyWasCalledEventually(pegomock.Times(3), 1*time.Second).
+		EnsureRunningState(matchers.AnyContextContext(), pegomock.EqBool(false))
+	assertCurrentVersion(t, dataPath, "1.8.0")
+	_, err = os.Stat(path.Join(dataPath, "agents", "TELEGRAF", "1.9.0"))
+	assert.True(t, os.IsNotExist(err), "failed version should have been removed")
+}
+
+func TestAgentsRunner_RevertWaitsForInstructionInProgress(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	viper.Set(config.AgentsUpgradeGracePeriod, 1*time.Minute)
+	defer viper.Set(config.AgentsUpgradeGracePeriod, 10*time.Second)
+
+	dataPath, err := ioutil.TempDir("", "test_agents")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	agentsRunner, mockSpecificAgentRunner := setupVersionsTest(t, dataPath, "1.8.0")
+	pegomock.When(mockSpecificAgentRunner.IsRunning()).ThenReturn(true)
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer ts.Close()
+	ack := agentsRunner.ProcessInstall(telegrafInstall(t, ts.URL, "1.9.0"))
+	require.True(t, ack.Success)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	pegomock.When(mockSpecificAgentRunner.ProcessConfig(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).
+		Then(func(params []pegomock.Param) pegomock.ReturnValues {
+			close(entered)
+			<-release
+			return pegomock.ReturnValues{[]*telemetry_edge.ConfigurationOpAck{{Id: "op-1", Success: true}}, nil}
+		})
+
+	configured := make(chan struct{})
+	go func() {
+		defer close(configured)
+		agentsRunner.ProcessConfigure(&telemetry_edge.EnvoyInstructionConfigure{
+			AgentType: telemetry_edge.AgentType_TELEGRAF,
+			Operations: []*telemetry_edge.ConfigurationOp{
+				{Id: "op-1", Type: telemetry_edge.ConfigurationOp_CREATE, Content: "config"},
+			},
+		})
+	}()
+	<-entered
+
+	// the upgraded agent exits while the configure instruction is being processed
+	runFailingAgent(t, agents.CommandHandlerOf(agentsRunner), mockSpecificAgentRunner)
+	time.Sleep(100 * time.Millisecond)
+	assertCurrentVersion(t, dataPath, "1.9.0")
+
+	close(release)
+	<-configured
+
+	// once to upgrade and again to revert
+	mockSpecificAgentRunner.VerifyWasCalledEventually(pegomock.Times(2), 1*time.Second).Stop()
+	assertCurrentVersion(t, dataPath, "1.8.0")
+}
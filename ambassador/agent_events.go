@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"sync"
+)
+
+// agentEventQueue holds agent events until they have been posted, which allows for events that
+// occur while disconnected from the Ambassador to be replayed after the next attachment
+type agentEventQueue struct {
+	sync.Mutex
+	events []*telemetry_edge.AgentEvent
+	max    int
+	// added is signaled when an event is added to the queue
+	added chan struct{}
+}
+
+func newAgentEventQueue(max int) *agentEventQueue {
+	return &agentEventQueue{
+		max:   max,
+		added: make(chan struct{}, 1),
+	}
+}
+
+func (q *agentEventQueue) add(event *telemetry_edge.AgentEvent) {
+	q.Lock()
+	q.events = append(q.events, event)
+	if q.max > 0 && len(q.events) > q.max {
+		log.WithField("dropped", q.events[0]).Warn("too many pending agent events, dropping oldest")
+		q.events[0] = nil
+		q.events = q.events[1:]
+	}
+	q.Unlock()
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+}
+
+// peek returns the oldest event or nil if the queue is empty
+func (q *agentEventQueue) peek() *telemetry_edge.AgentEvent {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.events) == 0 {
+		return nil
+	}
+	return q.events[0]
+}
+
+// remove removes the given event if it's still the oldest one
+func (q *agentEventQueue) remove(event *telemetry_edge.AgentEvent) {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.events) > 0 && q.events[0] == event {
+		q.events[0] = nil
+		q.events = q.events[1:]
+	}
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/auth"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"strings"
+	"time"
+)
+
+// certRenewalFinalLead is how long before the current certificate expires that renewal is tried
+// again when renewal only loaded the same certificate, such as certificate files that haven't been
+// replaced yet
+const certRenewalFinalLead = 5 * time.Minute
+
+// certificateNotRenewedError indicates that the loaded certificate doesn't expire any later than
+// the current one
+type certificateNotRenewedError struct {
+	expires time.Time
+}
+
+func (e *certificateNotRenewedError) Error() string {
+	return fmt.Sprintf("loaded certificate expires no later than the current one at %s", e.expires)
+}
+
+// certificateRejections are the TLS alerts conveying that the Ambassador didn't accept the client certificate
+var certificateRejections = []string{
+	"tls: expired certificate",
+	"tls: bad certificate",
+	"tls: revoked certificate",
+	"tls: unknown certificate authority",
+}
+
+func isCertificateRejected(err error) bool {
+	for _, rejection := range certificateRejections {
+		if strings.Contains(err.Error(), rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StandardEgressConnection) loadTlsDialOption() (grpc.DialOption, *tls.Certificate, error) {
+	if c.TlsDisabled {
+		return grpc.WithInsecure(), nil, nil
+	}
+
+	certificate, certPool, err := auth.LoadCertificates()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transportCreds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{*certificate},
+		RootCAs:      certPool,
+	})
+	return grpc.WithTransportCredentials(transportCreds), certificate, nil
+}
+
+// loadCertificates (re)loads the client certificates used by subsequent attachments and
+// schedules their renewal
+func (c *StandardEgressConnection) loadCertificates() error {
+	dialOption, certificate, err := c.loadTlsDialOption()
+	if err != nil {
+		return err
+	}
+
+	c.setCertificates(dialOption, certificate)
+	return nil
+}
+
+func (c *StandardEgressConnection) setCertificates(dialOption grpc.DialOption, certificate *tls.Certificate) {
+	renewAt := time.Time{}
+	if certificate != nil {
+		leaf, err := certificateLeaf(certificate)
+		if err != nil {
+			log.WithError(err).Warn("unable to determine lifetime of certificate, it will not be renewed")
+		} else {
+			lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+			renewAt = leaf.NotBefore.Add(time.Duration(float64(lifetime) * c.CertRenewalFraction))
+			log.WithFields(log.Fields{
+				"expires": leaf.NotAfter,
+				"renewAt": renewAt,
+			}).Debug("loaded client certificate")
+		}
+	}
+
+	c.tlsMutex.Lock()
+	defer c.tlsMutex.Unlock()
+	c.grpcTlsDialOption = dialOption
+	c.certificate = certificate
+	c.certificateRenewAt = renewAt
+}
+
+func (c *StandardEgressConnection) tlsDialOption() grpc.DialOption {
+	c.tlsMutex.Lock()
+	defer c.tlsMutex.Unlock()
+	return c.grpcTlsDialOption
+}
+
+// renewCertificates renews the client certificates once they reach the configured portion of
+// their lifetime, until the given context is done. Attachments continue to use the current
+// certificates while renewal is retried.
+func (c *StandardEgressConnection) renewCertificates(ctx context.Context) {
+	for {
+		c.tlsMutex.Lock()
+		renewAt := c.certificateRenewAt
+		certificate := c.certificate
+		c.tlsMutex.Unlock()
+
+		if renewAt.IsZero() {
+			return
+		}
+
+		if wait := time.Until(renewAt); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+				// check again, since the certificates could have been reloaded in the meantime
+				continue
+			}
+		}
+
+		expiresSoon := false
+		if leaf, err := certificateLeaf(certificate); err == nil {
+			expiresSoon = time.Until(leaf.NotAfter) <= certRenewalFinalLead
+		}
+
+		log.WithField("renewAt", renewAt).Info("renewing client certificates")
+		retryBackOff := backoff.NewExponentialBackOff()
+		retryBackOff.InitialInterval = c.CertRenewalRetryDelay
+		retryBackOff.MaxElapsedTime = 0
+		err := backoff.RetryNotify(func() error {
+			err := c.renewCertificate(certificate)
+			if _, notRenewed := err.(*certificateNotRenewedError); notRenewed && !expiresSoon {
+				return backoff.Permanent(err)
+			}
+			return err
+		}, backoff.WithContext(retryBackOff, ctx),
+			func(err error, delay time.Duration) {
+				log.WithError(err).WithField("delay", delay).Warn("failed to renew certificates, will retry")
+			})
+		if notRenewed, ok := err.(*certificateNotRenewedError); ok {
+			// retrying until then would only load the same certificate over and over
+			retryAt := notRenewed.expires.Add(-certRenewalFinalLead)
+			log.WithFields(log.Fields{
+				"expires": notRenewed.expires,
+				"retryAt": retryAt,
+			}).Warn("loaded the same client certificate, will try renewing again shortly before it expires")
+			c.tlsMutex.Lock()
+			if c.certificate == certificate {
+				c.certificateRenewAt = retryAt
+			}
+			c.tlsMutex.Unlock()
+			continue
+		}
+		if err != nil {
+			// only when the context is done
+			return
+		}
+
+		log.Info("renewed client certificates")
+		select {
+		case c.certificatesRenewed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// renewCertificate loads new certificates, which must expire later than the current certificate
+func (c *StandardEgressConnection) renewCertificate(current *tls.Certificate) error {
+	dialOption, certificate, err := c.loadTlsDialOption()
+	if err != nil {
+		return err
+	}
+
+	currentLeaf, err := certificateLeaf(current)
+	if err != nil {
+		return err
+	}
+	renewedLeaf, err := certificateLeaf(certificate)
+	if err != nil {
+		return err
+	}
+	if !renewedLeaf.NotAfter.After(currentLeaf.NotAfter) {
+		return &certificateNotRenewedError{expires: currentLeaf.NotAfter}
+	}
+
+	c.setCertificates(dialOption, certificate)
+	return nil
+}
+
+func certificateLeaf(certificate *tls.Certificate) (*x509.Certificate, error) {
+	if certificate.Leaf != nil {
+		return certificate.Leaf, nil
+	}
+	if len(certificate.Certificate) == 0 {
+		return nil, errors.New("certificate chain is empty")
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse certificate")
+	}
+	return leaf, nil
+}
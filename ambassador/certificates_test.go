@@ -0,0 +1,218 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/petergtz/pegomock"
+	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func createTestCertificate(t *testing.T, serial int64, lifetime time.Duration, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		// centered on now, so that renewal at half its lifetime is due immediately
+		NotBefore:   time.Now().Add(-lifetime / 2),
+		NotAfter:    time.Now().Add(lifetime / 2),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = issuer.cert, issuer.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCertificate{cert: cert, key: key}
+}
+
+func (c *testCertificate) certPem() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c *testCertificate) keyPem(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string) {
+	require.NoError(t, ioutil.WriteFile(certFile, c.certPem(), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, c.keyPem(t), 0600))
+}
+
+// startRenewalTest starts a connection using the client certificate provided by the given files,
+// attached to an Ambassador that requires a client certificate issued by ca
+func startRenewalTest(t *testing.T, dataPath string, certFile, keyFile string, ca *testCertificate,
+	fraction float64) (ambassador.EgressConnection, *TestingAmbassadorService, func()) {
+
+	serverCert := createTestCertificate(t, 2, 24*time.Hour, ca)
+	caFile := filepath.Join(dataPath, "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, ca.certPem(), 0600))
+
+	serverKeyPair, err := tls.X509KeyPair(serverCert.certPem(), serverCert.keyPem(t))
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	grpcServer := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})))
+
+	done := make(chan struct{})
+	ambassadorService := NewTestingAmbassadorService(done)
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go grpcServer.Serve(listener)
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, listener.Addr().String())
+	viper.Set("tls.disabled", false)
+	viper.Set("tls.provided.cert", certFile)
+	viper.Set("tls.provided.key", keyFile)
+	viper.Set("tls.provided.ca", caFile)
+	viper.Set(config.TlsRenewalLifetimeFraction, fraction)
+	viper.Set(config.TlsRenewalRetryDelay, 50*time.Millisecond)
+	egressConnection, err := ambassador.NewEgressConnection(NewMockRouter(), idGenerator)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+
+	return egressConnection, ambassadorService, func() {
+		cancel()
+		close(done)
+		grpcServer.Stop()
+		viper.Set("tls.disabled", true)
+		viper.Set(config.TlsRenewalLifetimeFraction, 0.7)
+		viper.Set(config.TlsRenewalRetryDelay, 10*time.Second)
+	}
+}
+
+func TestStandardEgressConnection_RenewsCertificates(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	ca := createTestCertificate(t, 1, 24*time.Hour, nil)
+	certFile := filepath.Join(dataPath, "client.pem")
+	keyFile := filepath.Join(dataPath, "client-key.pem")
+	// renewal is due a second from now and it expires soon after
+	createTestCertificate(t, 10, 10*time.Second, ca).write(t, certFile, keyFile)
+
+	_, ambassadorService, stop := startRenewalTest(t, dataPath, certFile, keyFile, ca, 0.6)
+	defer stop()
+
+	select {
+	case <-ambassadorService.attaches:
+		assert.Equal(t, "10", ambassadorService.clientSerialViaAttach)
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not see attachment in time")
+	}
+
+	createTestCertificate(t, 11, 4*time.Hour, ca).write(t, certFile, keyFile)
+
+	select {
+	case <-ambassadorService.attaches:
+		assert.Equal(t, "11", ambassadorService.clientSerialViaAttach)
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not see attachment with renewed certificate in time")
+	}
+}
+
+func TestStandardEgressConnection_RenewsCertificates_NotReplaced(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	ca := createTestCertificate(t, 1, 24*time.Hour, nil)
+	certFile := filepath.Join(dataPath, "client.pem")
+	keyFile := filepath.Join(dataPath, "client-key.pem")
+	// renewal is due right away, but the files keep providing the same certificate
+	clientCert := createTestCertificate(t, 10, 2*time.Hour, ca)
+	clientCert.write(t, certFile, keyFile)
+
+	egressConnection, ambassadorService, stop := startRenewalTest(t, dataPath, certFile, keyFile, ca, 0.5)
+	defer stop()
+
+	select {
+	case <-ambassadorService.attaches:
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not see attachment in time")
+	}
+
+	// rather than retrying, renewal is put off until shortly before the certificate expires
+	expected := clientCert.cert.NotAfter.Add(-5 * time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for !ambassador.CertificateRenewAtForTesting(egressConnection).Equal(expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("renewal was not put off, renewAt=%s",
+				ambassador.CertificateRenewAtForTesting(egressConnection))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
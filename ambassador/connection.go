@@ -21,43 +21,49 @@ import (
 	"crypto/tls"
 	"fmt"
 	"github.com/cenkalti/backoff"
+	"github.com/golang/protobuf/proto"
 	"github.com/pkg/errors"
 	"github.com/racker/telemetry-envoy/agents"
 	"github.com/racker/telemetry-envoy/auth"
 	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/netproxy"
 	"github.com/racker/telemetry-envoy/telemetry_edge"
-	"github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
-	"strings"
+	"google.golang.org/grpc/status"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
 const (
 	EnvoyIdHeader = "x-envoy-id"
+	// EnvoyAttachHeader conveys the number of times this Envoy process has attached, starting at 1
+	EnvoyAttachHeader = "x-envoy-attach"
+	// egressQueueSubpath is the directory, within the data path, of the queue of data to be posted
+	egressQueueSubpath = "egress-queue"
+	// AmbassadorFeaturesHeader is the response header of AttachEnvoy where the Ambassador lists
+	// the optional features that it supports, separated by commas
+	AmbassadorFeaturesHeader = "x-ambassador-features"
+	// FeaturePostMetrics indicates the Ambassador supports the PostMetrics batch call
+	FeaturePostMetrics = "post-metrics"
+	// featureDetectionTimeout bounds how long posting waits for the Ambassador to advertise
+	// its features after attaching
+	featureDetectionTimeout = time.Second
 )
 
 type EgressConnection interface {
 	Start(ctx context.Context, supportedAgents []telemetry_edge.AgentType)
+	// PostLogEvent queues the log event to be posted while attached to the Ambassador
 	PostLogEvent(agentType telemetry_edge.AgentType, jsonContent string)
+	// PostMetric queues the metric to be posted while attached to the Ambassador
 	PostMetric(metric *telemetry_edge.Metric)
-}
-
-type IdGenerator interface {
-	Generate() string
-}
-
-type StandardIdGenerator struct{}
-
-func NewIdGenerator() IdGenerator {
-	return &StandardIdGenerator{}
-}
-
-func (g *StandardIdGenerator) Generate() string {
-	return uuid.NewV1().String()
+	// PostAgentEvent queues the event to be posted while attached to the Ambassador
+	PostAgentEvent(event *telemetry_edge.AgentEvent)
 }
 
 type StandardEgressConnection struct {
@@ -65,25 +71,53 @@ type StandardEgressConnection struct {
 	TlsDisabled       bool
 	GrpcCallLimit     time.Duration
 	KeepAliveInterval time.Duration
-
-	client            telemetry_edge.TelemetryAmbassadorClient
-	envoyId           string
-	ctx               context.Context
-	agentsRunner      agents.Router
-	grpcTlsDialOption grpc.DialOption
-	certificate       *tls.Certificate
-	supportedAgents   []telemetry_edge.AgentType
-	idGenerator       IdGenerator
-	labels            map[string]string
-	resourceId        string
+	// MetricsBatchSize is the maximum number of metrics posted in one call
+	MetricsBatchSize int
+	// MetricsFlushInterval is the longest that queued metrics wait for a batch to fill up
+	MetricsFlushInterval time.Duration
+	// FailbackAfter is how long to stay attached to a secondary endpoint before trying the primary again
+	FailbackAfter time.Duration
+	// CertRenewalFraction is the portion of the client certificate's lifetime after which it is renewed
+	CertRenewalFraction float64
+	// CertRenewalRetryDelay is the initial delay before retrying a failed renewal
+	CertRenewalRetryDelay time.Duration
+
+	client       telemetry_edge.TelemetryAmbassadorClient
+	envoyId      string
+	attachCount  int64
+	ctx          context.Context
+	agentsRunner agents.Router
+	// tlsMutex guards the certificate state, which is renewed concurrently with attachments
+	tlsMutex            sync.Mutex
+	grpcTlsDialOption   grpc.DialOption
+	certificate         *tls.Certificate
+	certificateRenewAt  time.Time
+	certificatesRenewed chan struct{}
+	supportedAgents     []telemetry_edge.AgentType
+	idGenerator         IdGenerator
+	labels              map[string]string
+	resourceId          string
 	// outgoingContext is used by gRPC client calls to build the final call context
 	outgoingContext context.Context
+	agentEvents     *agentEventQueue
+	egressQueue     *egressQueue
+	endpoints       *ambassadorEndpoints
+	// proxy is the explicitly configured proxy to connect through, if any
+	proxy *netproxy.Config
 }
 
 func init() {
 	viper.SetDefault(config.AmbassadorAddress, "localhost:6565")
+	viper.SetDefault(config.AmbassadorFailbackAfter, 10*time.Minute)
 	viper.SetDefault("grpc.callLimit", 30*time.Second)
+	viper.SetDefault(config.TlsRenewalRetryDelay, 10*time.Second)
 	viper.SetDefault("ambassador.keepAliveInterval", 10*time.Second)
+	viper.SetDefault("ambassador.maxPendingAgentEvents", 100)
+	viper.SetDefault("ambassador.metricsBatch.size", 500)
+	viper.SetDefault("ambassador.metricsBatch.flushInterval", 1*time.Second)
+	viper.SetDefault("ambassador.queue.maxSize", 100*1024*1024)
+	viper.SetDefault("ambassador.queue.maxAge", 24*time.Hour)
+	viper.SetDefault("ambassador.queue.dropPolicy", EgressDropOldest)
 }
 
 func NewEgressConnection(agentsRunner agents.Router, idGenerator IdGenerator) (EgressConnection, error) {
@@ -93,21 +127,48 @@ func NewEgressConnection(agentsRunner agents.Router, idGenerator IdGenerator) (E
 	}
 
 	connection := &StandardEgressConnection{
-		Address:           viper.GetString(config.AmbassadorAddress),
-		TlsDisabled:       viper.GetBool("tls.disabled"),
-		GrpcCallLimit:     viper.GetDuration("grpc.callLimit"),
-		KeepAliveInterval: viper.GetDuration("ambassador.keepAliveInterval"),
-		agentsRunner:      agentsRunner,
-		idGenerator:       idGenerator,
-		resourceId:        resourceId,
+		Address:               viper.GetString(config.AmbassadorAddress),
+		TlsDisabled:           viper.GetBool("tls.disabled"),
+		GrpcCallLimit:         viper.GetDuration("grpc.callLimit"),
+		KeepAliveInterval:     viper.GetDuration("ambassador.keepAliveInterval"),
+		MetricsBatchSize:      viper.GetInt("ambassador.metricsBatch.size"),
+		MetricsFlushInterval:  viper.GetDuration("ambassador.metricsBatch.flushInterval"),
+		FailbackAfter:         viper.GetDuration(config.AmbassadorFailbackAfter),
+		CertRenewalFraction:   viper.GetFloat64(config.TlsRenewalLifetimeFraction),
+		CertRenewalRetryDelay: viper.GetDuration(config.TlsRenewalRetryDelay),
+		agentsRunner:          agentsRunner,
+		idGenerator:           idGenerator,
+		resourceId:            resourceId,
+		agentEvents:           newAgentEventQueue(viper.GetInt("ambassador.maxPendingAgentEvents")),
+		endpoints:             newAmbassadorEndpoints(),
+		certificatesRenewed:   make(chan struct{}, 1),
+	}
+
+	// renewing at the start or end of the lifetime would renew and re-attach continuously
+	if connection.CertRenewalFraction <= 0 || connection.CertRenewalFraction >= 1 {
+		return nil, errors.Errorf("%s must be between 0 and 1, exclusive, but was %v",
+			config.TlsRenewalLifetimeFraction, connection.CertRenewalFraction)
+	}
+
+	err := connection.loadCertificates()
+	if err != nil {
+		return nil, err
 	}
 
-	var err error
-	connection.grpcTlsDialOption, err = connection.loadTlsDialOption()
+	connection.proxy, err = netproxy.LoadConfig()
 	if err != nil {
 		return nil, err
 	}
 
+	connection.egressQueue, err = newEgressQueue(
+		filepath.Join(viper.GetString(config.AgentsDataPath), egressQueueSubpath),
+		viper.GetInt64("ambassador.queue.maxSize"),
+		viper.GetDuration("ambassador.queue.maxAge"),
+		viper.GetString("ambassador.queue.dropPolicy"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open egress queue")
+	}
+
 	connection.labels, err = config.ComputeLabels()
 	if err != nil {
 		return nil, err
@@ -124,10 +185,15 @@ func (c *StandardEgressConnection) Start(ctx context.Context, supportedAgents []
 	c.ctx = ctx
 	c.supportedAgents = supportedAgents
 
+	if !c.TlsDisabled {
+		go c.renewCertificates(ctx)
+	}
+
 	for {
 		select {
 		case <-c.ctx.Done():
 			log.Info("Stopping egress connection handling")
+			c.egressQueue.close()
 			return
 
 		default:
@@ -137,11 +203,11 @@ func (c *StandardEgressConnection) Start(ctx context.Context, supportedAgents []
 
 					cause := errors.Cause(err)
 					if cause != nil && cause != err {
-						if strings.Contains(cause.Error(), "tls: expired certificate") {
-							log.Warn("authenticating certificate has expired, reloading certificates")
+						if isCertificateRejected(cause) {
+							log.WithError(cause).Warn("authenticating certificate was rejected, reloading certificates")
 
-							var loadErr error
-							c.grpcTlsDialOption, loadErr = c.loadTlsDialOption()
+							auth.DiscardCachedCertificates()
+							loadErr := c.loadCertificates()
 							if loadErr != nil {
 								log.WithError(loadErr).Warn("failed to reload certificates")
 							}
@@ -151,18 +217,33 @@ func (c *StandardEgressConnection) Start(ctx context.Context, supportedAgents []
 			if err != nil {
 				log.WithError(err).Warn("failure during retry section")
 			}
-
-			c.envoyId = c.idGenerator.Generate()
 		}
 	}
 }
 
-func (c *StandardEgressConnection) attach() error {
+func (c *StandardEgressConnection) attach() (err error) {
+	c.Address = c.endpoints.current()
+	attached := false
+	defer func() {
+		// move on to the next endpoint only when this one couldn't be attached at all
+		if err != nil && !attached {
+			c.endpoints.advance()
+		}
+	}()
+
+	// this attachment will use the latest certificates anyway
+	select {
+	case <-c.certificatesRenewed:
+	default:
+	}
 
+	// the identity is retained across attachments, but is looked up each time in case it was rotated
 	c.envoyId = c.idGenerator.Generate()
+	c.attachCount++
 	log.
 		WithField("ambassadorAddress", c.Address).
 		WithField("envoyId", c.envoyId).
+		WithField("attach", c.attachCount).
 		Info("dialing ambassador")
 	// use a blocking dial, but fail on non-temp errors so that we can catch connectivity errors here rather than during
 	// the attach operation
@@ -170,12 +251,17 @@ func (c *StandardEgressConnection) attach() error {
 	dialTimeoutCtx, dialTimeoutCancel := context.WithTimeout(c.ctx, c.GrpcCallLimit)
 	defer dialTimeoutCancel()
 
-	conn, err := grpc.DialContext(dialTimeoutCtx,
-		c.Address,
-		c.grpcTlsDialOption,
+	dialOptions := []grpc.DialOption{
+		c.tlsDialOption(),
 		grpc.WithBlock(),
 		grpc.FailOnNonTempDialError(true),
-	)
+	}
+	if c.proxy != nil {
+		log.WithField("proxy", c.proxy.Url.Host).Debug("dialing ambassador through proxy")
+		dialOptions = append(dialOptions, grpc.WithDialer(c.proxy.GrpcDialer))
+	}
+
+	conn, err := grpc.DialContext(dialTimeoutCtx, c.Address, dialOptions...)
 	if err != nil {
 		return errors.Wrap(err, "failed to dial Ambassador")
 	}
@@ -183,7 +269,10 @@ func (c *StandardEgressConnection) attach() error {
 	defer conn.Close()
 
 	c.client = telemetry_edge.NewTelemetryAmbassadorClient(conn)
-	callMetadata := metadata.Pairs(EnvoyIdHeader, c.envoyId)
+	callMetadata := metadata.Pairs(
+		EnvoyIdHeader, c.envoyId,
+		EnvoyAttachHeader, strconv.FormatInt(c.attachCount, 10),
+	)
 
 	// connCtx creates a scope where the go routines for each connection can all be
 	// cancelled in one-shot when an error is reported by any of them. It also inherits
@@ -194,9 +283,15 @@ func (c *StandardEgressConnection) attach() error {
 	outgoingCtx := metadata.NewOutgoingContext(connCtx, callMetadata)
 	c.outgoingContext = outgoingCtx
 
+	labels := make(map[string]string, len(c.labels)+1)
+	for name, value := range c.labels {
+		labels[name] = value
+	}
+	labels[config.AmbassadorEndpointLabel] = c.Address
+
 	envoySummary := &telemetry_edge.EnvoySummary{
 		SupportedAgents: c.supportedAgents,
-		Labels:          c.labels,
+		Labels:          labels,
 		ResourceId:      c.resourceId,
 		Zone:            viper.GetString(config.Zone),
 	}
@@ -206,11 +301,24 @@ func (c *StandardEgressConnection) attach() error {
 	if err != nil {
 		return errors.Wrap(err, "failed to attach Envoy")
 	}
+	attached = true
+	log.WithField("ambassadorAddress", c.Address).Info("attached to ambassador")
+
+	// while attached to a secondary endpoint, periodically go back to the primary endpoint
+	var failback <-chan time.Time
+	if !c.endpoints.isPrimary() && c.FailbackAfter > 0 {
+		failbackTimer := time.NewTimer(c.FailbackAfter)
+		defer failbackTimer.Stop()
+		failback = failbackTimer.C
+	}
 
 	errChan := make(chan error, 10)
+	features := detectAmbassadorFeatures(instructions)
 
 	go c.watchForInstructions(outgoingCtx, errChan, instructions)
 	go c.sendKeepAlives(outgoingCtx, errChan)
+	go c.sendAgentEvents(outgoingCtx)
+	go c.sendQueuedEntries(outgoingCtx, features)
 
 	for {
 		select {
@@ -224,34 +332,288 @@ func (c *StandardEgressConnection) attach() error {
 		case err := <-errChan:
 			log.WithError(err).Warn("terminating")
 			cancelFunc()
+
+		case <-c.certificatesRenewed:
+			log.Info("re-attaching with renewed certificates")
+			cancelFunc()
+
+		case <-failback:
+			log.WithField("ambassadorAddress", c.Address).Info("failing back to primary ambassador endpoint")
+			c.endpoints.reset()
+			cancelFunc()
 		}
 	}
 }
 
 func (c *StandardEgressConnection) PostLogEvent(agentType telemetry_edge.AgentType, jsonContent string) {
-	callCtx, callCancel := context.WithTimeout(c.outgoingContext, c.GrpcCallLimit)
-	defer callCancel()
-
-	log.Debug("posting log event")
-	_, err := c.client.PostLogEvent(callCtx, &telemetry_edge.LogEvent{
+	log.Debug("queuing log event")
+	c.enqueue(egressLogEvent, &telemetry_edge.LogEvent{
 		AgentType:   agentType,
 		JsonContent: jsonContent,
 	})
+}
+
+func (c *StandardEgressConnection) PostMetric(metric *telemetry_edge.Metric) {
+	log.WithField("metric", metric).Debug("queuing metric")
+	c.enqueue(egressMetric, &telemetry_edge.PostedMetric{
+		Metric: metric,
+	})
+}
+
+func (c *StandardEgressConnection) enqueue(kind egressEntryKind, message proto.Message) {
+	payload, err := proto.Marshal(message)
+	if err != nil {
+		log.WithError(err).Warn("failed to encode data for posting")
+		return
+	}
+
+	err = c.egressQueue.enqueue(kind, payload)
 	if err != nil {
-		log.WithError(err).Warn("failed to post log event")
+		if IsEgressQueueFull(err) {
+			log.Warn("egress queue is full, dropping newest data")
+		} else {
+			log.WithError(err).Warn("failed to queue data for posting")
+		}
 	}
 }
 
-func (c *StandardEgressConnection) PostMetric(metric *telemetry_edge.Metric) {
-	callCtx, callCancel := context.WithTimeout(c.outgoingContext, c.GrpcCallLimit)
+// sendQueuedEntries posts the queued metrics and log events in order, including those that were
+// queued prior to this attachment, until the given context is done. Metrics are posted in batches
+// when the Ambassador supports it. Entries the Ambassador rejects are discarded, whereas posts that
+// failed transiently are retried.
+func (c *StandardEgressConnection) sendQueuedEntries(ctx context.Context, features *ambassadorFeatures) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-features.detected:
+	case <-time.After(featureDetectionTimeout):
+	}
+
+	batchSize := c.MetricsBatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+
+	for {
+		entries, err := c.egressQueue.read(batchSize)
+		if err != nil {
+			log.WithError(err).Warn("failed to read egress queue")
+		} else if len(entries) == 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.egressQueue.added:
+			}
+			continue
+		} else if features.postMetrics() && len(entries) < batchSize {
+			// give the batch a chance to fill up
+			if wait := c.MetricsFlushInterval - time.Since(entries[0].enqueuedAt); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-c.egressQueue.added:
+				case <-time.After(wait):
+				}
+				continue
+			}
+		}
+
+		if err == nil {
+			err = c.postQueuedEntries(ctx, features, entries)
+			if err != nil {
+				log.WithError(err).Warn("failed to post queued data, will retry")
+			}
+		}
+
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.KeepAliveInterval):
+			}
+		}
+	}
+}
+
+// postQueuedEntries posts the entries in order and consumes them from the queue as they're posted
+func (c *StandardEgressConnection) postQueuedEntries(ctx context.Context, features *ambassadorFeatures,
+	entries []*egressEntry) error {
+
+	// metrics accumulates a batch, which is posted prior to any log event to retain the order
+	var metrics []*telemetry_edge.Metric
+
+	for i, entry := range entries {
+		switch entry.kind {
+		case egressMetric:
+			var posted telemetry_edge.PostedMetric
+			if err := proto.Unmarshal(entry.payload, &posted); err != nil {
+				log.WithError(err).Warn("discarding queued metric that could not be decoded")
+				break
+			}
+			if features.postMetrics() {
+				metrics = append(metrics, posted.Metric)
+				break
+			}
+			if err := discardIfRejected(c.postMetric(ctx, &posted), "metric"); err != nil {
+				return err
+			}
+
+		case egressLogEvent:
+			if len(metrics) > 0 {
+				if err := c.postMetrics(ctx, features, metrics); err != nil {
+					return err
+				}
+				metrics = nil
+				c.egressQueue.commit(entries[:i])
+			}
+
+			var logEvent telemetry_edge.LogEvent
+			if err := proto.Unmarshal(entry.payload, &logEvent); err != nil {
+				log.WithError(err).Warn("discarding queued log event that could not be decoded")
+				break
+			}
+			if err := discardIfRejected(c.postLogEvent(ctx, &logEvent), "log event"); err != nil {
+				return err
+			}
+
+		default:
+			log.WithField("kind", entry.kind).Warn("discarding queued entry of unknown kind")
+		}
+
+		if len(metrics) == 0 {
+			c.egressQueue.commit(entries[:i+1])
+		}
+	}
+
+	if len(metrics) > 0 {
+		if err := c.postMetrics(ctx, features, metrics); err != nil {
+			return err
+		}
+		c.egressQueue.commit(entries)
+	}
+	return nil
+}
+
+// postMetrics posts the metrics in one call or, if the Ambassador turns out not to support
+// that or rejects the batch, one at a time
+func (c *StandardEgressConnection) postMetrics(ctx context.Context, features *ambassadorFeatures,
+	metrics []*telemetry_edge.Metric) error {
+
+	callCtx, callCancel := context.WithTimeout(ctx, c.GrpcCallLimit)
 	defer callCancel()
 
-	log.WithField("metric", metric).Debug("posting metric")
-	_, err := c.client.PostMetric(callCtx, &telemetry_edge.PostedMetric{
-		Metric: metric,
+	log.WithField("count", len(metrics)).Debug("posting metrics")
+	_, err := c.client.PostMetrics(callCtx, &telemetry_edge.PostedMetrics{
+		Metrics: metrics,
 	})
+	if status.Code(err) == codes.Unimplemented {
+		log.Info("Ambassador does not implement posting batches of metrics, posting individually")
+		features.disablePostMetrics()
+	} else if isRejected(err) {
+		// such as when the batch is too large, so only the offending metrics are discarded
+		log.WithError(err).WithField("count", len(metrics)).
+			Warn("Ambassador rejected batch of metrics, posting individually")
+	} else {
+		return err
+	}
+
+	for _, metric := range metrics {
+		err = discardIfRejected(c.postMetric(ctx, &telemetry_edge.PostedMetric{Metric: metric}), "metric")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isRejected indicates the Ambassador rejected the posted data such that posting it again would
+// fail the same way, as opposed to a transient failure of the call
+func isRejected(err error) bool {
+	switch status.Code(err) {
+	case codes.OK, codes.Unavailable, codes.DeadlineExceeded, codes.Canceled, codes.Aborted,
+		codes.Internal, codes.Unknown:
+		return false
+	default:
+		return true
+	}
+}
+
+// discardIfRejected logs and absorbs the error of posting data that the Ambassador rejected, so
+// that it gets consumed from the queue rather than blocking the data queued after it
+func discardIfRejected(err error, kind string) error {
+	if !isRejected(err) {
+		return err
+	}
+	log.WithError(err).WithField("kind", kind).Warn("discarding queued data rejected by the Ambassador")
+	return nil
+}
+
+func (c *StandardEgressConnection) postMetric(ctx context.Context, metric *telemetry_edge.PostedMetric) error {
+	callCtx, callCancel := context.WithTimeout(ctx, c.GrpcCallLimit)
+	defer callCancel()
+
+	_, err := c.client.PostMetric(callCtx, metric)
+	return err
+}
+
+func (c *StandardEgressConnection) postLogEvent(ctx context.Context, logEvent *telemetry_edge.LogEvent) error {
+	callCtx, callCancel := context.WithTimeout(ctx, c.GrpcCallLimit)
+	defer callCancel()
+
+	_, err := c.client.PostLogEvent(callCtx, logEvent)
+	return err
+}
+
+func (c *StandardEgressConnection) PostAgentEvent(event *telemetry_edge.AgentEvent) {
+	log.WithField("event", event).Debug("queuing agent event")
+	c.agentEvents.add(event)
+}
+
+// sendAgentEvents posts the queued agent events, including those that were queued prior to
+// this attachment, until the given context is done. The events are discarded for the rest of
+// the attachment if the Ambassador doesn't implement posting them.
+func (c *StandardEgressConnection) sendAgentEvents(ctx context.Context) {
+	unimplemented := false
+	for {
+		for event := c.agentEvents.peek(); event != nil; event = c.agentEvents.peek() {
+			if !unimplemented {
+				callCtx, callCancel := context.WithTimeout(ctx, c.GrpcCallLimit)
+				_, err := c.client.PostAgentEvent(callCtx, event)
+				callCancel()
+				if status.Code(err) == codes.Unimplemented {
+					log.Info("Ambassador does not implement posting agent events, discarding them")
+					unimplemented = true
+				} else if err = discardIfRejected(err, "agent event"); err != nil {
+					log.WithError(err).Warn("failed to post agent event, will retry")
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(c.KeepAliveInterval):
+						continue
+					}
+				}
+			}
+
+			c.agentEvents.remove(event)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.agentEvents.added:
+		}
+	}
+}
+
+// postInstructionAck reports the outcome of an instruction back to the Ambassador
+func (c *StandardEgressConnection) postInstructionAck(ctx context.Context, ack *telemetry_edge.InstructionAck) {
+	callCtx, callCancel := context.WithTimeout(ctx, c.GrpcCallLimit)
+	defer callCancel()
+
+	log.WithField("ack", ack).Debug("posting instruction ack")
+	_, err := c.client.PostInstructionAck(callCtx, ack)
 	if err != nil {
-		log.WithError(err).Warn("failed to post metric")
+		log.WithError(err).Warn("failed to post instruction ack")
 	}
 }
 
@@ -274,24 +636,6 @@ func (c *StandardEgressConnection) sendKeepAlives(ctx context.Context, errChan c
 	}
 }
 
-func (c *StandardEgressConnection) loadTlsDialOption() (grpc.DialOption, error) {
-	if c.TlsDisabled {
-		return grpc.WithInsecure(), nil
-	}
-
-	certificate, certPool, err := auth.LoadCertificates()
-	if err != nil {
-		return nil, err
-	}
-	c.certificate = certificate
-
-	transportCreds := credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{*certificate},
-		RootCAs:      certPool,
-	})
-	return grpc.WithTransportCredentials(transportCreds), nil
-}
-
 func (c *StandardEgressConnection) watchForInstructions(ctx context.Context,
 	errChan chan<- error, instructions telemetry_edge.TelemetryAmbassador_AttachEnvoyClient) {
 	for {
@@ -308,13 +652,24 @@ func (c *StandardEgressConnection) watchForInstructions(ctx context.Context,
 
 			switch {
 			case instruction.GetInstall() != nil:
-				c.agentsRunner.ProcessInstall(instruction.GetInstall())
+				ack := c.agentsRunner.ProcessInstall(instruction.GetInstall())
+				c.postInstructionAck(ctx, &telemetry_edge.InstructionAck{
+					Details: &telemetry_edge.InstructionAck_Install{Install: ack},
+				})
 
 			case instruction.GetConfigure() != nil:
-				c.agentsRunner.ProcessConfigure(instruction.GetConfigure())
+				ack := c.agentsRunner.ProcessConfigure(instruction.GetConfigure())
+				c.postInstructionAck(ctx, &telemetry_edge.InstructionAck{
+					Details: &telemetry_edge.InstructionAck_Configure{Configure: ack},
+				})
+
+			case instruction.GetRollback() != nil:
+				c.agentsRunner.ProcessRollback(instruction.GetRollback())
 
 			case instruction.GetRefresh() != nil:
-				//TODO
+				for _, ack := range c.agentsRunner.ProcessRefresh(instruction.GetRefresh()) {
+					c.postInstructionAck(ctx, ack)
+				}
 			}
 		}
 	}
@@ -23,6 +23,7 @@ import (
 	"github.com/petergtz/pegomock"
 	"github.com/phayes/freeport"
 	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/racker/telemetry-envoy/ambassador/matchers"
 	"github.com/racker/telemetry-envoy/config"
 	"github.com/racker/telemetry-envoy/telemetry_edge"
 	"github.com/spf13/viper"
@@ -30,24 +31,49 @@ import (
 	"github.com/stretchr/testify/require"
 	netContext "golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
 	"net"
+	"os"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 type TestingAmbassadorService struct {
 	idViaAttach       string
+	attachViaAttach   string
 	idViaKeepAlive    string
 	idViaPostMetric   string
 	idViaPostLogEvent string
+	// clientSerialViaAttach is the serial number of the client certificate, when using TLS
+	clientSerialViaAttach string
 
 	done       chan struct{}
 	attaches   chan *telemetry_edge.EnvoySummary
 	keepAlives chan *telemetry_edge.KeepAliveRequest
 	logs       chan *telemetry_edge.LogEvent
 	metrics    chan *telemetry_edge.PostedMetric
+	events     chan *telemetry_edge.AgentEvent
+	acks       chan *telemetry_edge.InstructionAck
+	// instructions are sent to the Envoy once it attaches
+	instructions []*telemetry_edge.EnvoyInstruction
+	// features are advertised to the Envoy when it attaches
+	features      []string
+	metricBatches chan *telemetry_edge.PostedMetrics
+	// rejectLogContent is the content of log events that are rejected as invalid
+	rejectLogContent string
+	// maxBatchSize, when set, rejects larger batches of metrics
+	maxBatchSize int
+	// agentEventsUnimplemented responds to posted agent events like an older Ambassador
+	agentEventsUnimplemented bool
+	agentEventCalls          int32
 }
 
 func NewTestingAmbassadorService(done chan struct{}) *TestingAmbassadorService {
@@ -57,14 +83,34 @@ func NewTestingAmbassadorService(done chan struct{}) *TestingAmbassadorService {
 		keepAlives: make(chan *telemetry_edge.KeepAliveRequest, 1),
 		logs:       make(chan *telemetry_edge.LogEvent, 1),
 		metrics:    make(chan *telemetry_edge.PostedMetric, 1),
+		events:     make(chan *telemetry_edge.AgentEvent, 10),
+		acks:       make(chan *telemetry_edge.InstructionAck, 10),
+
+		metricBatches: make(chan *telemetry_edge.PostedMetrics, 10),
 	}
 }
 
 func (s *TestingAmbassadorService) AttachEnvoy(summary *telemetry_edge.EnvoySummary, resp telemetry_edge.TelemetryAmbassador_AttachEnvoyServer) error {
 	if md, ok := metadata.FromIncomingContext(resp.Context()); ok {
 		s.idViaAttach = md.Get(ambassador.EnvoyIdHeader)[0]
+		s.attachViaAttach = md.Get(ambassador.EnvoyAttachHeader)[0]
+	}
+	if p, ok := peer.FromContext(resp.Context()); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			s.clientSerialViaAttach = tlsInfo.State.PeerCertificates[0].SerialNumber.String()
+		}
+	}
+	err := resp.SendHeader(metadata.Pairs(ambassador.AmbassadorFeaturesHeader, strings.Join(s.features, ",")))
+	if err != nil {
+		return err
 	}
 	s.attaches <- summary
+	for _, instruction := range s.instructions {
+		err := resp.Send(instruction)
+		if err != nil {
+			return err
+		}
+	}
 	<-s.done
 	return nil
 }
@@ -81,6 +127,9 @@ func (s *TestingAmbassadorService) PostLogEvent(ctx netContext.Context, log *tel
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		s.idViaPostLogEvent = md.Get(ambassador.EnvoyIdHeader)[0]
 	}
+	if s.rejectLogContent != "" && log.JsonContent == s.rejectLogContent {
+		return nil, status.Error(codes.InvalidArgument, "invalid log event")
+	}
 	s.logs <- log
 	return &telemetry_edge.PostLogEventResponse{}, nil
 }
@@ -93,6 +142,28 @@ func (s *TestingAmbassadorService) PostMetric(ctx netContext.Context, metric *te
 	return &telemetry_edge.PostMetricResponse{}, nil
 }
 
+func (s *TestingAmbassadorService) PostMetrics(ctx netContext.Context, metrics *telemetry_edge.PostedMetrics) (*telemetry_edge.PostMetricsResponse, error) {
+	if s.maxBatchSize > 0 && len(metrics.Metrics) > s.maxBatchSize {
+		return nil, status.Error(codes.ResourceExhausted, "batch is too large")
+	}
+	s.metricBatches <- metrics
+	return &telemetry_edge.PostMetricsResponse{}, nil
+}
+
+func (s *TestingAmbassadorService) PostAgentEvent(ctx netContext.Context, event *telemetry_edge.AgentEvent) (*telemetry_edge.PostAgentEventResponse, error) {
+	atomic.AddInt32(&s.agentEventCalls, 1)
+	if s.agentEventsUnimplemented {
+		return nil, status.Error(codes.Unimplemented, "unknown method PostAgentEvent")
+	}
+	s.events <- event
+	return &telemetry_edge.PostAgentEventResponse{}, nil
+}
+
+func (s *TestingAmbassadorService) PostInstructionAck(ctx netContext.Context, ack *telemetry_edge.InstructionAck) (*telemetry_edge.PostInstructionAckResponse, error) {
+	s.acks <- ack
+	return &telemetry_edge.PostInstructionAckResponse{}, nil
+}
+
 func TestStandardEgressConnection_Start(t *testing.T) {
 	pegomock.RegisterMockTestingT(t)
 
@@ -118,6 +189,10 @@ func TestStandardEgressConnection_Start(t *testing.T) {
 	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
 
 	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
 	viper.Set(config.ResourceId, "ourResourceId")
 	viper.Set(config.Zone, "myZone")
 	viper.Set(config.AmbassadorAddress, ambassadorAddr)
@@ -134,6 +209,7 @@ func TestStandardEgressConnection_Start(t *testing.T) {
 	case summary := <-ambassadorService.attaches:
 		assert.Equal(t, "ourResourceId", summary.ResourceId)
 		assert.Equal(t, "id-1", ambassadorService.idViaAttach)
+		assert.Equal(t, "1", ambassadorService.attachViaAttach)
 		assert.Equal(t, "myZone", summary.Zone)
 	case <-time.After(500 * time.Millisecond):
 		t.Error("did not see attachment in time")
@@ -161,6 +237,23 @@ func TestStandardEgressConnection_MissingResourceId(t *testing.T) {
 	require.Nil(t, egressConnection)
 }
 
+func TestStandardEgressConnection_InvalidRenewalFraction(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	viper.Set(config.ResourceId, "ourResourceId")
+	defer viper.Set(config.TlsRenewalLifetimeFraction, 0.7)
+
+	for _, fraction := range []float64{0, -0.5, 1, 1.5} {
+		viper.Set(config.TlsRenewalLifetimeFraction, fraction)
+		egressConnection, err := ambassador.NewEgressConnection(NewMockRouter(), idGenerator)
+		assert.Error(t, err, "fraction %v", fraction)
+		assert.Nil(t, egressConnection, "fraction %v", fraction)
+	}
+}
+
 func TestStandardEgressConnection_PostMetric(t *testing.T) {
 	pegomock.RegisterMockTestingT(t)
 
@@ -186,6 +279,10 @@ func TestStandardEgressConnection_PostMetric(t *testing.T) {
 	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
 
 	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
 	viper.Set(config.ResourceId, "ourResourceId")
 	viper.Set(config.AmbassadorAddress, ambassadorAddr)
 	viper.Set("tls.disabled", true)
@@ -254,6 +351,10 @@ func TestStandardEgressConnection_PostLogEvent(t *testing.T) {
 	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
 
 	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
 	viper.Set(config.ResourceId, "ourResourceId")
 	viper.Set(config.AmbassadorAddress, ambassadorAddr)
 	viper.Set("tls.disabled", true)
@@ -284,3 +385,445 @@ func TestStandardEgressConnection_PostLogEvent(t *testing.T) {
 		t.Error("did not see posted metric in time")
 	}
 }
+
+func TestStandardEgressConnection_PostAgentEvent(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	// events that occur prior to attaching are replayed after attaching
+	egressConnection.PostAgentEvent(&telemetry_edge.AgentEvent{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+		Type:  telemetry_edge.AgentEvent_INSTALLED,
+	})
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	select {
+	case event := <-ambassadorService.events:
+		assert.Equal(t, telemetry_edge.AgentEvent_INSTALLED, event.Type)
+		assert.Equal(t, "1.9.0", event.Agent.Version)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see replayed agent event in time")
+	}
+
+	egressConnection.PostAgentEvent(&telemetry_edge.AgentEvent{
+		Agent:    &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+		Type:     telemetry_edge.AgentEvent_EXITED,
+		ExitCode: 1,
+		Output:   []string{"bad config"},
+	})
+
+	select {
+	case event := <-ambassadorService.events:
+		assert.Equal(t, telemetry_edge.AgentEvent_EXITED, event.Type)
+		assert.Equal(t, int32(1), event.ExitCode)
+		assert.Equal(t, []string{"bad config"}, event.Output)
+	case <-time.After(100 * time.Millisecond):
+		t.Error("did not see agent event in time")
+	}
+}
+
+func TestStandardEgressConnection_PostAgentEvent_Unimplemented(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	ambassadorService.agentEventsUnimplemented = true
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	viper.Set("ambassador.keepAliveInterval", 10*time.Millisecond)
+	defer viper.Set("ambassador.keepAliveInterval", 10*time.Second)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	egressConnection.PostAgentEvent(&telemetry_edge.AgentEvent{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+		Type:  telemetry_edge.AgentEvent_INSTALLED,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	select {
+	case <-ambassadorService.attaches:
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see attachment in time")
+	}
+
+	egressConnection.PostAgentEvent(&telemetry_edge.AgentEvent{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+		Type:  telemetry_edge.AgentEvent_STARTED,
+	})
+
+	// several keep alive intervals, which is when a failed post would be retried
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&ambassadorService.agentEventCalls))
+}
+
+func TestStandardEgressConnection_PostsInstructionAcks(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	install := &telemetry_edge.EnvoyInstructionInstall{
+		Agent: &telemetry_edge.Agent{Type: telemetry_edge.AgentType_TELEGRAF, Version: "1.9.0"},
+	}
+	configure := &telemetry_edge.EnvoyInstructionConfigure{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOp{
+			{Id: "op-1", Revision: "3"},
+		},
+	}
+	ambassadorService.instructions = []*telemetry_edge.EnvoyInstruction{
+		{Details: &telemetry_edge.EnvoyInstruction_Install{Install: install}},
+		{Details: &telemetry_edge.EnvoyInstruction_Configure{Configure: configure}},
+		{Details: &telemetry_edge.EnvoyInstruction_Refresh{Refresh: &telemetry_edge.EnvoyInstructionRefresh{}}},
+	}
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	pegomock.When(mockAgentsRunner.ProcessInstall(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionInstall())).ThenReturn(&telemetry_edge.InstallAck{
+		Agent: install.Agent,
+		Error: "failed to download",
+	})
+	pegomock.When(mockAgentsRunner.ProcessConfigure(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionConfigure())).ThenReturn(&telemetry_edge.ConfigureAck{
+		AgentType: telemetry_edge.AgentType_TELEGRAF,
+		Operations: []*telemetry_edge.ConfigurationOpAck{
+			{Id: "op-1", Revision: "3", Success: true},
+		},
+	})
+	pegomock.When(mockAgentsRunner.ProcessRefresh(matchers.AnyPtrToTelemetryEdgeEnvoyInstructionRefresh())).
+		ThenReturn([]*telemetry_edge.InstructionAck{
+			{Details: &telemetry_edge.InstructionAck_Configure{Configure: &telemetry_edge.ConfigureAck{
+				AgentType: telemetry_edge.AgentType_FILEBEAT,
+			}}},
+		})
+
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	select {
+	case ack := <-ambassadorService.acks:
+		require.NotNil(t, ack.GetInstall())
+		assert.False(t, ack.GetInstall().Success)
+		assert.Equal(t, "failed to download", ack.GetInstall().Error)
+		assert.Equal(t, "1.9.0", ack.GetInstall().Agent.Version)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see install ack in time")
+	}
+
+	select {
+	case ack := <-ambassadorService.acks:
+		require.NotNil(t, ack.GetConfigure())
+		require.Len(t, ack.GetConfigure().Operations, 1)
+		assert.Equal(t, "op-1", ack.GetConfigure().Operations[0].Id)
+		assert.Equal(t, "3", ack.GetConfigure().Operations[0].Revision)
+		assert.True(t, ack.GetConfigure().Operations[0].Success)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see configure ack in time")
+	}
+	select {
+	case ack := <-ambassadorService.acks:
+		require.NotNil(t, ack.GetConfigure())
+		assert.Equal(t, telemetry_edge.AgentType_FILEBEAT, ack.GetConfigure().AgentType)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see refresh ack in time")
+	}
+}
+
+func TestStandardEgressConnection_PostMetric_BeforeAttach(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	// data that is posted prior to attaching is queued and posted in order after attaching
+	for _, name := range []string{"cpu", "mem"} {
+		egressConnection.PostMetric(&telemetry_edge.Metric{
+			Variant: &telemetry_edge.Metric_NameTagValue{
+				NameTagValue: &telemetry_edge.NameTagValueMetric{Name: name},
+			},
+		})
+	}
+	egressConnection.PostLogEvent(telemetry_edge.AgentType_FILEBEAT, `{"testing":"value"}`)
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	for _, name := range []string{"cpu", "mem"} {
+		select {
+		case postedMetric := <-ambassadorService.metrics:
+			assert.Equal(t, name, postedMetric.Metric.GetNameTagValue().Name)
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("did not see queued metric in time")
+		}
+	}
+
+	select {
+	case logEvent := <-ambassadorService.logs:
+		assert.Equal(t, `{"testing":"value"}`, logEvent.JsonContent)
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("did not see queued log event in time")
+	}
+}
+
+func TestStandardEgressConnection_PostMetrics(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	ambassadorService.features = []string{"other", ambassador.FeaturePostMetrics}
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	viper.Set("ambassador.metricsBatch.size", 3)
+	defer viper.Set("ambassador.metricsBatch.size", 500)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	for _, name := range []string{"m1", "m2", "m3", "m4"} {
+		egressConnection.PostMetric(&telemetry_edge.Metric{
+			Variant: &telemetry_edge.Metric_NameTagValue{
+				NameTagValue: &telemetry_edge.NameTagValueMetric{Name: name},
+			},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	// the first batch is full, and the remainder is flushed after the flush interval
+	for _, expected := range [][]string{{"m1", "m2", "m3"}, {"m4"}} {
+		select {
+		case batch := <-ambassadorService.metricBatches:
+			var names []string
+			for _, metric := range batch.Metrics {
+				names = append(names, metric.GetNameTagValue().Name)
+			}
+			assert.Equal(t, expected, names)
+		case <-time.After(2 * time.Second):
+			t.Fatal("did not see batch of metrics in time")
+		}
+	}
+
+	select {
+	case <-ambassadorService.metrics:
+		t.Error("metrics should not have been posted individually")
+	default:
+	}
+}
+
+func TestStandardEgressConnection_DiscardsRejectedEntries(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	defer grpcServer.Stop()
+
+	done := make(chan struct{}, 1)
+	defer close(done)
+	ambassadorService := NewTestingAmbassadorService(done)
+	ambassadorService.features = []string{ambassador.FeaturePostMetrics}
+	ambassadorService.rejectLogContent = `{"invalid":true}`
+	ambassadorService.maxBatchSize = 1
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	mockAgentsRunner := NewMockRouter()
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set(config.AmbassadorAddress, ambassadorAddr)
+	viper.Set("tls.disabled", true)
+	viper.Set("ambassador.metricsBatch.size", 2)
+	defer viper.Set("ambassador.metricsBatch.size", 500)
+	egressConnection, err := ambassador.NewEgressConnection(mockAgentsRunner, idGenerator)
+	require.NoError(t, err)
+
+	egressConnection.PostLogEvent(telemetry_edge.AgentType_FILEBEAT, `{"invalid":true}`)
+	egressConnection.PostLogEvent(telemetry_edge.AgentType_FILEBEAT, `{"testing":"value"}`)
+	for _, name := range []string{"m1", "m2"} {
+		egressConnection.PostMetric(&telemetry_edge.Metric{
+			Variant: &telemetry_edge.Metric_NameTagValue{
+				NameTagValue: &telemetry_edge.NameTagValueMetric{Name: name},
+			},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_FILEBEAT})
+	defer cancel()
+
+	// the rejected log event doesn't hold up the ones queued after it
+	select {
+	case logEvent := <-ambassadorService.logs:
+		assert.Equal(t, `{"testing":"value"}`, logEvent.JsonContent)
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not see posted log event in time")
+	}
+
+	// the rejected batch is posted individually instead
+	for _, expected := range []string{"m1", "m2"} {
+		select {
+		case metric := <-ambassadorService.metrics:
+			assert.Equal(t, expected, metric.Metric.GetNameTagValue().Name)
+		case <-time.After(2 * time.Second):
+			t.Fatal("did not see posted metric in time")
+		}
+	}
+}
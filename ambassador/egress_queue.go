@@ -0,0 +1,559 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// each record is the payload length, a CRC32 of the rest of the record, the time it was
+	// enqueued in Unix nanoseconds, the kind of entry, and then the payload
+	egressRecordHeaderSize   = 4 + 4 + 8 + 1
+	egressSegmentExt         = ".wal"
+	egressCursorFilename     = "cursor"
+	egressCursorSyncInterval = time.Second
+	// maxEgressSegmentSize bounds each segment file, which is also the granularity at which
+	// the oldest entries are dropped
+	maxEgressSegmentSize = 4 * 1024 * 1024
+	egressDirPerms       = 0700
+	egressFilePerms      = 0600
+
+	EgressDropOldest = "oldest"
+	EgressDropNewest = "newest"
+)
+
+type egressEntryKind byte
+
+const (
+	egressMetric   egressEntryKind = 1
+	egressLogEvent egressEntryKind = 2
+)
+
+type egressEntry struct {
+	kind       egressEntryKind
+	enqueuedAt time.Time
+	payload    []byte
+	// the position that follows this entry
+	segment uint64
+	next    int64
+}
+
+type egressCursor struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+type egressQueueFullError struct{}
+
+func (e *egressQueueFullError) Error() string {
+	return "egress queue is full"
+}
+
+// IsEgressQueueFull tests if an error indicates that an entry was dropped since the egress queue
+// was full and configured to drop the newest entries
+func IsEgressQueueFull(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := errors.Cause(err).(*egressQueueFullError)
+	return ok
+}
+
+// egressQueue is a write-ahead log of the data waiting to be posted to the Ambassador. It is
+// made up of segment files that are written in order and a cursor file that tracks the position
+// of the next entry to be posted. Entries are delivered at least once, so a few entries might be
+// posted again after an unclean shutdown.
+type egressQueue struct {
+	sync.Mutex
+	dir         string
+	maxSize     int64
+	maxAge      time.Duration
+	segmentSize int64
+	dropNewest  bool
+
+	// segments are ordered oldest first and the last one is being written
+	segments     []uint64
+	segmentSizes map[uint64]int64
+	totalSize    int64
+	writer       *os.File
+	writeOffset  int64
+
+	readSegment   uint64
+	readOffset    int64
+	cursorSavedAt time.Time
+
+	// added is signaled when an entry is added to the queue
+	added chan struct{}
+}
+
+// newEgressQueue opens the queue stored in dir, creating it if needed. A maxSize or maxAge of
+// zero disables that limit. The dropPolicy decides if the oldest or newest entries are dropped
+// when the queue is full.
+func newEgressQueue(dir string, maxSize int64, maxAge time.Duration, dropPolicy string) (*egressQueue, error) {
+	q := &egressQueue{
+		dir:          dir,
+		maxSize:      maxSize,
+		maxAge:       maxAge,
+		segmentSize:  maxEgressSegmentSize,
+		segmentSizes: make(map[uint64]int64),
+		added:        make(chan struct{}, 1),
+	}
+
+	switch strings.ToLower(dropPolicy) {
+	case EgressDropOldest, "":
+	case EgressDropNewest:
+		q.dropNewest = true
+	default:
+		return nil, errors.Errorf("unknown egress queue drop policy: %s", dropPolicy)
+	}
+
+	// a few segments are needed so that dropping the oldest one frees up a reasonable portion
+	if maxSize > 0 && q.segmentSize > maxSize/4 {
+		q.segmentSize = maxSize / 4
+		if q.segmentSize < egressRecordHeaderSize {
+			return nil, errors.Errorf("egress queue max size of %d is too small", maxSize)
+		}
+	}
+
+	err := os.MkdirAll(dir, egressDirPerms)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create egress queue directory")
+	}
+
+	err = q.loadSegments()
+	if err != nil {
+		return nil, err
+	}
+	q.loadCursor()
+
+	// always start a fresh segment, which avoids appending after a partially written record
+	err = q.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	log.WithFields(log.Fields{
+		"path":     dir,
+		"segments": len(q.segments),
+		"size":     q.totalSize,
+	}).Debug("opened egress queue")
+
+	return q, nil
+}
+
+func (q *egressQueue) segmentPath(segment uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", segment, egressSegmentExt))
+}
+
+func (q *egressQueue) loadSegments() error {
+	entries, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read egress queue directory")
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != egressSegmentExt {
+			continue
+		}
+		segment, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), egressSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, segment)
+		q.segmentSizes[segment] = entry.Size()
+		q.totalSize += entry.Size()
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i] < q.segments[j]
+	})
+	return nil
+}
+
+func (q *egressQueue) loadCursor() {
+	if len(q.segments) > 0 {
+		q.readSegment = q.segments[0]
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(q.dir, egressCursorFilename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).Warn("unable to read egress queue cursor, starting from oldest entry")
+		}
+		return
+	}
+
+	var cursor egressCursor
+	err = json.Unmarshal(content, &cursor)
+	if err != nil {
+		log.WithError(err).Warn("unable to parse egress queue cursor, starting from oldest entry")
+		return
+	}
+
+	if _, exists := q.segmentSizes[cursor.Segment]; exists {
+		q.readSegment = cursor.Segment
+		q.readOffset = cursor.Offset
+	}
+	q.removeConsumedSegments()
+}
+
+func (q *egressQueue) saveCursor() {
+	content, err := json.Marshal(&egressCursor{
+		Segment: q.readSegment,
+		Offset:  q.readOffset,
+	})
+	if err != nil {
+		log.WithError(err).Warn("unable to encode egress queue cursor")
+		return
+	}
+
+	cursorPath := filepath.Join(q.dir, egressCursorFilename)
+	err = ioutil.WriteFile(cursorPath+".tmp", content, egressFilePerms)
+	if err == nil {
+		err = os.Rename(cursorPath+".tmp", cursorPath)
+	}
+	if err != nil {
+		log.WithError(err).Warn("unable to save egress queue cursor")
+		return
+	}
+	q.cursorSavedAt = time.Now()
+}
+
+// rotate starts a new segment for writing
+func (q *egressQueue) rotate() error {
+	next := uint64(1)
+	if len(q.segments) > 0 {
+		next = q.segments[len(q.segments)-1] + 1
+	}
+
+	writer, err := os.OpenFile(q.segmentPath(next), os.O_CREATE|os.O_EXCL|os.O_WRONLY, egressFilePerms)
+	if err != nil {
+		return errors.Wrap(err, "failed to create egress queue segment")
+	}
+
+	if q.writer != nil {
+		err = q.writer.Sync()
+		if err != nil {
+			log.WithError(err).Warn("failed to sync egress queue segment")
+		}
+		q.writer.Close()
+	}
+
+	q.writer = writer
+	q.writeOffset = 0
+	q.segments = append(q.segments, next)
+	q.segmentSizes[next] = 0
+	if len(q.segments) == 1 {
+		q.readSegment = next
+		q.readOffset = 0
+	}
+
+	q.dropExpiredSegments()
+	return nil
+}
+
+func (q *egressQueue) isWriteSegment(segment uint64) bool {
+	return len(q.segments) > 0 && q.segments[len(q.segments)-1] == segment
+}
+
+// nextSegment returns the segment that follows the given one
+func (q *egressQueue) nextSegment(segment uint64) uint64 {
+	for _, s := range q.segments {
+		if s > segment {
+			return s
+		}
+	}
+	return q.segments[len(q.segments)-1]
+}
+
+// dropOldestSegment removes the oldest segment even if it has not been consumed yet.
+// Returns false if only the segment being written remains.
+func (q *egressQueue) dropOldestSegment() bool {
+	if len(q.segments) <= 1 {
+		return false
+	}
+
+	oldest := q.segments[0]
+	q.removeSegment(oldest)
+	if q.readSegment <= oldest {
+		q.readSegment = q.segments[0]
+		q.readOffset = 0
+	}
+	return true
+}
+
+// dropExpiredSegments removes the segments that were last written before the max age
+func (q *egressQueue) dropExpiredSegments() {
+	if q.maxAge <= 0 {
+		return
+	}
+
+	cutoff := time.Now().Add(-q.maxAge)
+	for len(q.segments) > 1 {
+		info, err := os.Stat(q.segmentPath(q.segments[0]))
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return
+		}
+		log.WithField("segment", q.segments[0]).Warn("dropping expired entries from egress queue")
+		q.dropOldestSegment()
+	}
+}
+
+// removeConsumedSegments removes the segments prior to the one being read
+func (q *egressQueue) removeConsumedSegments() {
+	for len(q.segments) > 1 && q.segments[0] < q.readSegment {
+		q.removeSegment(q.segments[0])
+	}
+}
+
+func (q *egressQueue) removeSegment(segment uint64) {
+	err := os.Remove(q.segmentPath(segment))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("segment", segment).Warn("failed to remove egress queue segment")
+	}
+
+	q.totalSize -= q.segmentSizes[segment]
+	delete(q.segmentSizes, segment)
+	for i, s := range q.segments {
+		if s == segment {
+			q.segments = append(q.segments[:i], q.segments[i+1:]...)
+			break
+		}
+	}
+}
+
+// enqueue appends an entry to the queue. When the queue is full, the oldest entries are dropped
+// to make room unless the newest entries are to be dropped, where an egressQueueFullError
+// is returned instead.
+func (q *egressQueue) enqueue(kind egressEntryKind, payload []byte) error {
+	recordSize := int64(egressRecordHeaderSize + len(payload))
+	if recordSize > q.segmentSize {
+		return errors.Errorf("entry of %d bytes is too large for the egress queue", len(payload))
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(record[8:16], uint64(time.Now().UnixNano()))
+	record[16] = byte(kind)
+	copy(record[egressRecordHeaderSize:], payload)
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	q.Lock()
+	defer q.Unlock()
+
+	if q.writer == nil {
+		return errors.New("egress queue is closed")
+	}
+
+	if q.writeOffset > 0 && q.writeOffset+recordSize > q.segmentSize {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for q.maxSize > 0 && q.totalSize+recordSize > q.maxSize {
+		if q.dropNewest {
+			return &egressQueueFullError{}
+		}
+		if len(q.segments) == 1 {
+			err := q.rotate()
+			if err != nil {
+				return err
+			}
+		}
+		log.WithField("segment", q.segments[0]).Warn("egress queue is full, dropping oldest entries")
+		q.dropOldestSegment()
+	}
+
+	n, err := q.writer.Write(record)
+	q.writeOffset += int64(n)
+	q.segmentSizes[q.segments[len(q.segments)-1]] += int64(n)
+	q.totalSize += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "failed to write to egress queue")
+	}
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// read returns up to max of the oldest entries without consuming them. Entries older than the
+// max age are skipped. Once posted, the entries are consumed by passing them to commit.
+func (q *egressQueue) read(max int) ([]*egressEntry, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	var entries []*egressEntry
+	for len(entries) < max && len(q.segments) > 0 {
+		segment, offset := q.readSegment, q.readOffset
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+			segment, offset = last.segment, last.next
+		}
+
+		batch, next, complete, err := q.readSegmentEntries(segment, offset, max-len(entries))
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, batch...)
+
+		if len(entries) == 0 {
+			// nothing to post prior to this point, such as expired entries
+			q.readOffset = next
+		}
+		if !complete || q.isWriteSegment(segment) {
+			break
+		}
+		if len(entries) > 0 {
+			// a batch doesn't span segments so that consumed segments are removed by commit
+			break
+		}
+
+		// everything in this segment has been consumed
+		q.readSegment = q.nextSegment(segment)
+		q.readOffset = 0
+		q.removeConsumedSegments()
+	}
+
+	return entries, nil
+}
+
+// readSegmentEntries reads up to max entries from the segment starting at offset. It returns
+// the offset following the last entry read or skipped and if the end of the segment was reached.
+func (q *egressQueue) readSegmentEntries(segment uint64, offset int64, max int) ([]*egressEntry, int64, bool, error) {
+	file, err := os.Open(q.segmentPath(segment))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, offset, true, nil
+		}
+		return nil, offset, false, errors.Wrap(err, "failed to open egress queue segment")
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, offset, false, errors.Wrap(err, "failed to stat egress queue segment")
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, offset, false, errors.Wrap(err, "failed to seek in egress queue segment")
+	}
+
+	var entries []*egressEntry
+	header := make([]byte, egressRecordHeaderSize)
+	for len(entries) < max {
+		_, err = io.ReadFull(file, header)
+		if err == io.EOF {
+			return entries, offset, true, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return entries, offset, false, errors.Wrap(err, "failed to read egress queue segment")
+		}
+
+		var payload []byte
+		if err == nil {
+			// the length is checked before the CRC, so a corrupt length must not drive the allocation
+			length := int64(binary.BigEndian.Uint32(header[0:4]))
+			if length > maxEgressSegmentSize || length > info.Size()-offset-egressRecordHeaderSize {
+				err = io.ErrUnexpectedEOF
+			} else {
+				payload = make([]byte, length)
+				_, err = io.ReadFull(file, payload)
+			}
+		}
+		if err != nil || crc32.Update(crc32.ChecksumIEEE(header[8:]), crc32.IEEETable, payload) !=
+			binary.BigEndian.Uint32(header[4:8]) {
+			// the rest of the segment can't be trusted, such as after an unclean shutdown
+			log.WithField("segment", segment).Warn("skipping corrupt remainder of egress queue segment")
+			if q.isWriteSegment(segment) {
+				err = q.rotate()
+				if err != nil {
+					return entries, offset, false, err
+				}
+			}
+			return entries, offset, true, nil
+		}
+
+		offset += int64(egressRecordHeaderSize + len(payload))
+		enqueuedAt := time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16])))
+		if q.maxAge > 0 && time.Since(enqueuedAt) > q.maxAge {
+			continue
+		}
+
+		entries = append(entries, &egressEntry{
+			kind:       egressEntryKind(header[16]),
+			enqueuedAt: enqueuedAt,
+			payload:    payload,
+			segment:    segment,
+			next:       offset,
+		})
+	}
+
+	return entries, offset, false, nil
+}
+
+// commit consumes the given entries, which were returned by the latest call to read
+func (q *egressQueue) commit(entries []*egressEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	last := entries[len(entries)-1]
+
+	q.Lock()
+	defer q.Unlock()
+
+	segmentChanged := last.segment != q.readSegment
+	q.readSegment = last.segment
+	q.readOffset = last.next
+	q.removeConsumedSegments()
+
+	if segmentChanged || time.Since(q.cursorSavedAt) >= egressCursorSyncInterval {
+		q.saveCursor()
+	}
+}
+
+// close persists the position of the queue and closes the segment being written
+func (q *egressQueue) close() {
+	q.Lock()
+	defer q.Unlock()
+
+	q.saveCursor()
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+}
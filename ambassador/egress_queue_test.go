@@ -0,0 +1,174 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador_test
+
+import (
+	"fmt"
+	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEgressQueue_OrderAndPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_egress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := ambassador.NewEgressQueueForTesting(dir, 0, 0, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, queue.Enqueue(fmt.Sprintf("entry-%d", i)))
+	}
+
+	entries, err := queue.Read(2, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"entry-1", "entry-2"}, entries)
+
+	// not committed, so read again
+	entries, err = queue.Read(2, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"entry-1", "entry-2"}, entries)
+	queue.Close()
+
+	// the remaining entries survive reopening the queue
+	queue, err = ambassador.NewEgressQueueForTesting(dir, 0, 0, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+	defer queue.Close()
+	require.NoError(t, queue.Enqueue("entry-6"))
+
+	var remaining []string
+	for {
+		entries, err = queue.Read(10, true)
+		require.NoError(t, err)
+		if len(entries) == 0 {
+			break
+		}
+		remaining = append(remaining, entries...)
+	}
+	assert.Equal(t, []string{"entry-3", "entry-4", "entry-5", "entry-6"}, remaining)
+}
+
+func TestEgressQueue_DropOldest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_egress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// segments hold two entries of this size
+	entry := strings.Repeat("x", 100)
+	queue, err := ambassador.NewEgressQueueForTesting(dir, 1000, 0, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	for i := 0; i < 20; i++ {
+		require.NoError(t, queue.Enqueue(fmt.Sprintf("%02d%s", i, entry[2:])))
+	}
+
+	var remaining []string
+	for {
+		entries, err := queue.Read(10, true)
+		require.NoError(t, err)
+		if len(entries) == 0 {
+			break
+		}
+		remaining = append(remaining, entries...)
+	}
+	require.NotEmpty(t, remaining)
+	assert.True(t, len(remaining) < 20, "oldest entries should have been dropped")
+	assert.NotEqual(t, "00", remaining[0][:2])
+	assert.Equal(t, "19", remaining[len(remaining)-1][:2])
+}
+
+func TestEgressQueue_DropNewest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_egress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	entry := strings.Repeat("x", 100)
+	queue, err := ambassador.NewEgressQueueForTesting(dir, 1000, 0, ambassador.EgressDropNewest)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	var fullErr error
+	for i := 0; i < 20 && fullErr == nil; i++ {
+		fullErr = queue.Enqueue(entry)
+	}
+	assert.True(t, ambassador.IsEgressQueueFull(fullErr))
+
+	entries, err := queue.Read(1, false)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestEgressQueue_MaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_egress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := ambassador.NewEgressQueueForTesting(dir, 0, 50*time.Millisecond, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	require.NoError(t, queue.Enqueue("expired"))
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, queue.Enqueue("current"))
+
+	entries, err := queue.Read(10, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"current"}, entries)
+}
+
+func TestEgressQueue_CorruptLength(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_egress")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	queue, err := ambassador.NewEgressQueueForTesting(dir, 0, 0, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+	require.NoError(t, queue.Enqueue("entry-1"))
+	require.NoError(t, queue.Enqueue("entry-2"))
+	queue.Close()
+
+	// a torn record whose length would otherwise allocate 4 GiB
+	segments, err := filepath.Glob(filepath.Join(dir, "*.wal"))
+	require.NoError(t, err)
+	require.Len(t, segments, 1)
+	segment, err := os.OpenFile(segments[0], os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = segment.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	require.NoError(t, err)
+	require.NoError(t, segment.Close())
+
+	queue, err = ambassador.NewEgressQueueForTesting(dir, 0, 0, ambassador.EgressDropOldest)
+	require.NoError(t, err)
+	defer queue.Close()
+
+	entries, err := queue.Read(10, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"entry-1", "entry-2"}, entries)
+
+	require.NoError(t, queue.Enqueue("entry-3"))
+	entries, err = queue.Read(10, true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"entry-3"}, entries)
+}
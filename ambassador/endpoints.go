@@ -0,0 +1,102 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// lookupSRV is a variable to allow for unit testing
+var lookupSRV = net.LookupSRV
+
+// ambassadorEndpoints tracks the Ambassador endpoint to attach to, which is either the first
+// of an ordered list of addresses or the targets of a DNS SRV record. The next endpoint is used
+// after a failure to attach and the list starts over from the primary endpoint once exhausted.
+type ambassadorEndpoints struct {
+	addresses []string
+	srvName   string
+
+	resolved []string
+	index    int
+}
+
+func newAmbassadorEndpoints() *ambassadorEndpoints {
+	addresses := viper.GetStringSlice(config.AmbassadorAddresses)
+	if len(addresses) == 0 {
+		addresses = []string{viper.GetString(config.AmbassadorAddress)}
+	}
+
+	return &ambassadorEndpoints{
+		addresses: addresses,
+		srvName:   viper.GetString(config.AmbassadorSrv),
+	}
+}
+
+// current returns the address of the endpoint to attach to
+func (e *ambassadorEndpoints) current() string {
+	if len(e.resolved) == 0 {
+		e.resolve()
+	}
+	return e.resolved[e.index]
+}
+
+// isPrimary indicates if the current endpoint is the most preferred one
+func (e *ambassadorEndpoints) isPrimary() bool {
+	return e.index == 0
+}
+
+// advance moves on to the next endpoint after the current one failed
+func (e *ambassadorEndpoints) advance() {
+	e.index++
+	if e.index >= len(e.resolved) {
+		// start over, which also picks up changes to the SRV record
+		e.reset()
+	}
+}
+
+// reset goes back to the primary endpoint
+func (e *ambassadorEndpoints) reset() {
+	e.index = 0
+	e.resolved = nil
+}
+
+func (e *ambassadorEndpoints) resolve() {
+	e.resolved = nil
+
+	if e.srvName != "" {
+		_, records, err := lookupSRV("", "", e.srvName)
+		if err != nil {
+			log.WithError(err).WithField("srv", e.srvName).
+				Warn("unable to look up Ambassador endpoints, using configured addresses")
+		}
+		// the records are already ordered by priority and randomized by weight
+		for _, record := range records {
+			e.resolved = append(e.resolved,
+				net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+	}
+
+	if len(e.resolved) == 0 {
+		e.resolved = e.addresses
+	}
+	log.WithField("endpoints", e.resolved).Debug("resolved Ambassador endpoints")
+}
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador_test
+
+import (
+	"context"
+	"github.com/petergtz/pegomock"
+	"github.com/phayes/freeport"
+	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func startEndpointsTestAmbassador(t *testing.T) (string, *TestingAmbassadorService, func()) {
+	ambassadorPort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+
+	ambassadorAddr := net.JoinHostPort("localhost", strconv.Itoa(ambassadorPort))
+	listener, err := net.Listen("tcp", ambassadorAddr)
+	require.NoError(t, err)
+
+	grpcServer := grpc.NewServer()
+	done := make(chan struct{})
+	ambassadorService := NewTestingAmbassadorService(done)
+	telemetry_edge.RegisterTelemetryAmbassadorServer(grpcServer, ambassadorService)
+
+	go grpcServer.Serve(listener)
+
+	return ambassadorAddr, ambassadorService, func() {
+		close(done)
+		grpcServer.Stop()
+	}
+}
+
+func setupEndpointsTest(t *testing.T) (ambassador.EgressConnection, func()) {
+	idGenerator := NewMockIdGenerator()
+	pegomock.When(idGenerator.Generate()).ThenReturn("id-1")
+
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	viper.Set(config.AgentsDataPath, dataPath)
+	viper.Set(config.ResourceId, "ourResourceId")
+	viper.Set("tls.disabled", true)
+	viper.Set("grpc.callLimit", 100*time.Millisecond)
+	egressConnection, err := ambassador.NewEgressConnection(NewMockRouter(), idGenerator)
+	require.NoError(t, err)
+
+	return egressConnection, func() {
+		viper.Set("grpc.callLimit", 30*time.Second)
+		viper.Set(config.AmbassadorAddresses, []string{})
+		viper.Set(config.AmbassadorSrv, "")
+		viper.Set(config.AmbassadorFailbackAfter, 10*time.Minute)
+		os.RemoveAll(dataPath)
+	}
+}
+
+func TestStandardEgressConnection_FailsOverToNextAddress(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorAddr, ambassadorService, stop := startEndpointsTestAmbassador(t)
+	defer stop()
+
+	unreachablePort, err := freeport.GetFreePort()
+	require.NoError(t, err)
+	unreachableAddr := net.JoinHostPort("localhost", strconv.Itoa(unreachablePort))
+
+	viper.Set(config.AmbassadorAddresses, []string{unreachableAddr, ambassadorAddr})
+	viper.Set(config.AmbassadorFailbackAfter, 100*time.Millisecond)
+	egressConnection, cleanup := setupEndpointsTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	select {
+	case summary := <-ambassadorService.attaches:
+		assert.Equal(t, ambassadorAddr, summary.Labels[config.AmbassadorEndpointLabel])
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not see attachment in time")
+	}
+
+	// fails back to the unreachable primary and then over to the secondary again
+	select {
+	case summary := <-ambassadorService.attaches:
+		assert.Equal(t, ambassadorAddr, summary.Labels[config.AmbassadorEndpointLabel])
+		attachCount, err := strconv.Atoi(ambassadorService.attachViaAttach)
+		require.NoError(t, err)
+		assert.True(t, attachCount >= 4, "expected an attempt at the primary in between, got %d", attachCount)
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not see attachment after failback in time")
+	}
+}
+
+func TestStandardEgressConnection_ResolvesSrvRecord(t *testing.T) {
+	pegomock.RegisterMockTestingT(t)
+
+	ambassadorAddr, ambassadorService, stop := startEndpointsTestAmbassador(t)
+	defer stop()
+
+	host, portStr, err := net.SplitHostPort(ambassadorAddr)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(portStr)
+	require.NoError(t, err)
+
+	var lookedUp string
+	ambassador.SetLookupSRVForTesting(func(service, proto, name string) (string, []*net.SRV, error) {
+		lookedUp = name
+		return name, []*net.SRV{{Target: host + ".", Port: uint16(port)}}, nil
+	})
+	defer ambassador.ResetLookupSRVForTesting()
+
+	viper.Set(config.AmbassadorSrv, "_ambassador._tcp.example.com")
+	egressConnection, cleanup := setupEndpointsTest(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go egressConnection.Start(ctx, []telemetry_edge.AgentType{telemetry_edge.AgentType_TELEGRAF})
+	defer cancel()
+
+	select {
+	case summary := <-ambassadorService.attaches:
+		assert.Equal(t, "_ambassador._tcp.example.com", lookedUp)
+		assert.Equal(t, ambassadorAddr, summary.Labels[config.AmbassadorEndpointLabel])
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not see attachment in time")
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync/atomic"
+)
+
+// ambassadorFeatures tracks the optional features advertised by the Ambassador for one attachment
+type ambassadorFeatures struct {
+	// detected is closed once the features are known
+	detected        chan struct{}
+	postMetricsFlag int32
+}
+
+// detectAmbassadorFeatures reads the features from the response headers of the attachment, which
+// become available in the background
+func detectAmbassadorFeatures(instructions telemetry_edge.TelemetryAmbassador_AttachEnvoyClient) *ambassadorFeatures {
+	features := &ambassadorFeatures{
+		detected: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(features.detected)
+
+		header, err := instructions.Header()
+		if err != nil {
+			log.WithError(err).Debug("unable to read Ambassador features")
+			return
+		}
+
+		for _, value := range header.Get(AmbassadorFeaturesHeader) {
+			for _, feature := range strings.Split(value, ",") {
+				switch strings.TrimSpace(feature) {
+				case FeaturePostMetrics:
+					atomic.StoreInt32(&features.postMetricsFlag, 1)
+				}
+			}
+		}
+		log.WithField("features", header.Get(AmbassadorFeaturesHeader)).Debug("detected Ambassador features")
+	}()
+
+	return features
+}
+
+// postMetrics indicates if batches of metrics can be posted
+func (f *ambassadorFeatures) postMetrics() bool {
+	return atomic.LoadInt32(&f.postMetricsFlag) == 1
+}
+
+func (f *ambassadorFeatures) disablePostMetrics() {
+	atomic.StoreInt32(&f.postMetricsFlag, 0)
+}
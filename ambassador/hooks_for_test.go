@@ -0,0 +1,79 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"net"
+	"time"
+)
+
+// NOTE this file is specifically declared in the ambassador package, but only compiled during testing due
+// to the file name. As such, it is used to enable unit testing access to package-private aspects
+
+// EgressQueueForTesting exposes the egress queue, where each entry is simply a string
+type EgressQueueForTesting struct {
+	queue *egressQueue
+}
+
+func NewEgressQueueForTesting(dir string, maxSize int64, maxAge time.Duration, dropPolicy string) (*EgressQueueForTesting, error) {
+	queue, err := newEgressQueue(dir, maxSize, maxAge, dropPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return &EgressQueueForTesting{queue: queue}, nil
+}
+
+func (q *EgressQueueForTesting) Enqueue(content string) error {
+	return q.queue.enqueue(egressMetric, []byte(content))
+}
+
+// Read returns up to max of the oldest entries and consumes them when commit is true
+func (q *EgressQueueForTesting) Read(max int, commit bool) ([]string, error) {
+	entries, err := q.queue.read(max)
+	if err != nil {
+		return nil, err
+	}
+	if commit {
+		q.queue.commit(entries)
+	}
+
+	var contents []string
+	for _, entry := range entries {
+		contents = append(contents, string(entry.payload))
+	}
+	return contents, nil
+}
+
+func (q *EgressQueueForTesting) Close() {
+	q.queue.close()
+}
+
+// SetLookupSRVForTesting replaces the DNS SRV lookup of the Ambassador endpoints
+func SetLookupSRVForTesting(lookup func(service, proto, name string) (string, []*net.SRV, error)) {
+	lookupSRV = lookup
+}
+
+func ResetLookupSRVForTesting() {
+	lookupSRV = net.LookupSRV
+}
+
+func CertificateRenewAtForTesting(connection EgressConnection) time.Time {
+	c := connection.(*StandardEgressConnection)
+	c.tlsMutex.Lock()
+	defer c.tlsMutex.Unlock()
+	return c.certificateRenewAt
+}
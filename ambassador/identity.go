@@ -0,0 +1,169 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador
+
+import (
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// envoyIdFilename is the file, within the data path, that holds the identity of the Envoy
+	envoyIdFilename = "envoy-id"
+	envoyIdPerms    = 0600
+)
+
+type IdGenerator interface {
+	Generate() string
+}
+
+// StandardIdGenerator provides the identity persisted under the data path, which is created
+// the first time it's needed. This allows for the Ambassador to correlate the attachments of the
+// Envoy across reconnects and restarts.
+type StandardIdGenerator struct {
+	sync.Mutex
+	dataPath string
+	// fallback is used when the identity can't be persisted, so that it's at least retained
+	// for the life of the process
+	fallback string
+}
+
+func NewIdGenerator() IdGenerator {
+	return &StandardIdGenerator{
+		dataPath: viper.GetString(config.AgentsDataPath),
+	}
+}
+
+func (g *StandardIdGenerator) Generate() string {
+	g.Lock()
+	defer g.Unlock()
+
+	idPath := filepath.Join(g.dataPath, envoyIdFilename)
+	id, err := readEnvoyId(idPath)
+	if err == nil {
+		return id
+	}
+	if !os.IsNotExist(errors.Cause(err)) {
+		log.WithError(err).WithField("path", idPath).Warn("unable to read Envoy identity, replacing it")
+	}
+
+	if g.fallback != "" {
+		id = g.fallback
+	} else {
+		id = uuid.NewV1().String()
+	}
+	err = writeEnvoyId(idPath, id)
+	if err != nil {
+		log.WithError(err).WithField("path", idPath).Warn("unable to persist Envoy identity")
+		g.fallback = id
+	}
+	return id
+}
+
+// RotateEnvoyId replaces the identity persisted under the data path with a new one, which is
+// returned. A running Envoy uses the new identity the next time it attaches to the Ambassador.
+func RotateEnvoyId(dataPath string) (string, error) {
+	id := uuid.NewV1().String()
+	err := writeEnvoyId(filepath.Join(dataPath, envoyIdFilename), id)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func readEnvoyId(idPath string) (string, error) {
+	content, err := ioutil.ReadFile(idPath)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read Envoy identity")
+	}
+
+	id := strings.TrimSpace(string(content))
+	if _, err := uuid.FromString(id); err != nil {
+		return "", errors.Wrap(err, "invalid Envoy identity")
+	}
+	return id, nil
+}
+
+func writeEnvoyId(idPath string, id string) error {
+	err := os.MkdirAll(filepath.Dir(idPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create directory for Envoy identity")
+	}
+
+	// synced before the rename, so that a crash can't leave behind a renamed, but empty, file
+	tempPath := idPath + ".tmp"
+	os.Remove(tempPath)
+	err = writeSyncedFile(tempPath, []byte(id+"\n"), envoyIdPerms)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to write Envoy identity")
+	}
+
+	err = os.Rename(tempPath, idPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to replace Envoy identity")
+	}
+
+	err = syncDir(filepath.Dir(idPath))
+	if err != nil {
+		return errors.Wrap(err, "failed to sync Envoy identity directory")
+	}
+	return nil
+}
+
+// writeSyncedFile creates the file, which must not already exist, and flushes its content to disk
+func writeSyncedFile(filename string, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	_, err = file.Write(content)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir flushes the directory entries, such as a newly renamed child, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer d.Close()
+
+	return d.Sync()
+}
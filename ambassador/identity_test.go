@@ -0,0 +1,80 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package ambassador_test
+
+import (
+	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStandardIdGenerator_Persistent(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	id := ambassador.NewIdGenerator().Generate()
+	require.NotEmpty(t, id)
+	info, err := os.Stat(filepath.Join(dataPath, "envoy-id"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// retained across attachments and restarts
+	generator := ambassador.NewIdGenerator()
+	assert.Equal(t, id, generator.Generate())
+	assert.Equal(t, id, generator.Generate())
+
+	rotated, err := ambassador.RotateEnvoyId(dataPath)
+	require.NoError(t, err)
+	assert.NotEqual(t, id, rotated)
+	assert.Equal(t, rotated, generator.Generate())
+
+	// an unusable identity is replaced
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dataPath, "envoy-id"), []byte("garbage"), 0600))
+	replaced := generator.Generate()
+	assert.NotEqual(t, "garbage", replaced)
+	assert.NotEqual(t, rotated, replaced)
+	assert.Equal(t, replaced, generator.Generate())
+}
+
+func TestRotateEnvoyId_StaleTempFile(t *testing.T) {
+	dataPath, err := ioutil.TempDir("", "test_envoy")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataPath)
+
+	// left behind by a write that was interrupted
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dataPath, "envoy-id.tmp"), nil, 0644))
+
+	id, err := ambassador.RotateEnvoyId(dataPath)
+	require.NoError(t, err)
+
+	content, err := ioutil.ReadFile(filepath.Join(dataPath, "envoy-id"))
+	require.NoError(t, err)
+	assert.Equal(t, id+"\n", string(content))
+	info, err := os.Stat(filepath.Join(dataPath, "envoy-id"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dataPath, "envoy-id.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -39,6 +39,11 @@ type TlsConfig struct {
 	AuthService *struct {
 		Url           string
 		TokenProvider string `mapstructure:"token_provider"`
+		// Mode is AuthServiceModeCsr to have the auth service sign a locally generated key or
+		// empty to have the auth service issue the key along with the certificate
+		Mode string
+		// KeyType is the type of key generated in csr mode, either KeyTypeEcdsa or KeyTypeRsa
+		KeyType string `mapstructure:"key_type"`
 	} `mapstructure:"auth_service"`
 }
 
@@ -19,15 +19,22 @@
 package auth
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"net/http"
+	"time"
 )
 
-type AuthServiceCertProvider struct{}
+// AuthServiceCertProvider obtains certificates from the auth service, reusing its HTTP client
+// for the requests made while providing them
+type AuthServiceCertProvider struct {
+	authHttpClient
+}
 
 type authServiceResponse struct {
 	Certificate          string `json:"certificate"`
@@ -37,57 +44,139 @@ type authServiceResponse struct {
 
 func (p *AuthServiceCertProvider) ProvideCertificates(config *TlsConfig) (*tls.Certificate, *x509.CertPool, error) {
 
-	log.WithField("config", config.AuthService).Debug("acquiring certificates from auth service")
+	cached := loadCachedCertificates(config)
+	if cached != nil && time.Now().Before(cached.renewAt) {
+		log.WithField("expires", cached.notAfter).Info("using cached certificates from auth service")
+		return p.loadFromResponse(cached.response)
+	}
 
-	provider, err := GetAuthTokenProvider(config.AuthService.TokenProvider)
+	resp, err := p.requestCertificates(config)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get AuthTokenProvider")
+		if cached != nil && time.Now().Before(cached.notAfter) {
+			log.WithError(err).WithField("expires", cached.notAfter).
+				Warn("unable to acquire certificates from auth service, using cached certificates")
+			return p.loadFromResponse(cached.response)
+		}
+		return nil, nil, err
 	}
 
-	token, err := provider.ProvideAuthToken()
+	certificate, certPool, err := p.loadFromResponse(*resp)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to get auth token")
+		return nil, nil, err
 	}
 
-	fullUrl, err := AppendUrlPath(config.AuthService.Url, "auth/cert")
+	err = saveCachedCertificates(config, resp)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to build request url")
+		log.WithError(err).Warn("failed to cache certificates from auth service")
 	}
+	return certificate, certPool, nil
+}
+
+func (p *AuthServiceCertProvider) requestCertificates(config *TlsConfig) (*authServiceResponse, error) {
+	if config.AuthService.Mode == AuthServiceModeCsr {
+		return p.requestSignedCertificate(config)
+	}
+
+	log.WithField("config", config.AuthService).Debug("acquiring certificates from auth service")
 
-	request, err := http.NewRequest("GET", fullUrl, nil)
+	resp, err := p.callAuthService(config, "GET", "auth/cert", nil)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to prepare auth service request")
+		return nil, err
 	}
 
-	for header, value := range token.Headers {
-		request.Header.Set(header, value)
+	if resp.Certificate == "" || resp.PrivateKey == "" || resp.IssuingCACertificate == "" {
+		return nil, errors.Errorf("auth service response was missing a required field: cert=%t, key=%t, ca=%t",
+			resp.Certificate != "", resp.PrivateKey != "", resp.IssuingCACertificate != "")
 	}
-	request.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
-	httpResp, err := client.Do(request)
+	return resp, nil
+}
+
+// callAuthService makes an authenticated request to the auth service, where body is
+// encoded as JSON, if not nil. When the auth service rejects a reused token, the request
+// is retried once with a new token.
+func (p *AuthServiceCertProvider) callAuthService(config *TlsConfig, method string, urlPath string,
+	body interface{}) (*authServiceResponse, error) {
+
+	provider, err := GetAuthTokenProvider(config.AuthService.TokenProvider)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failure during auth service request")
+		return nil, errors.Wrap(err, "failed to get AuthTokenProvider")
 	}
+
+	fullUrl, err := AppendUrlPath(config.AuthService.Url, urlPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build request url")
+	}
+
+	var encodedBody []byte
+	if body != nil {
+		encodedBody, err = json.Marshal(body)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encode auth service request")
+		}
+	}
+
+	client, err := p.httpClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create auth service client")
+	}
+
+	for retried := false; ; retried = true {
+		token, err := provider.ProvideAuthToken()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get auth token")
+		}
+
+		var reqBody io.Reader
+		if encodedBody != nil {
+			reqBody = bytes.NewReader(encodedBody)
+		}
+		request, err := http.NewRequest(method, fullUrl, reqBody)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to prepare auth service request")
+		}
+
+		for header, value := range token.Headers {
+			request.Header.Set(header, value)
+		}
+		request.Header.Set("Accept", "application/json")
+		if encodedBody != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+
+		httpResp, err := client.Do(request)
+		if err != nil {
+			return nil, errors.Wrap(err, "failure during auth service request")
+		}
+
+		if httpResp.StatusCode == http.StatusUnauthorized && !retried {
+			if refreshable, ok := provider.(RefreshableAuthTokenProvider); ok {
+				httpResp.Body.Close()
+				log.Warn("auth service rejected the auth token, retrying with a new token")
+				refreshable.InvalidateAuthToken()
+				continue
+			}
+		}
+
+		return decodeAuthServiceResponse(httpResp)
+	}
+}
+
+func decodeAuthServiceResponse(httpResp *http.Response) (*authServiceResponse, error) {
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != 200 {
-		return nil, nil, errors.Errorf("http request to auth service failed: %s", httpResp.Status)
+		return nil, errors.Errorf("http request to auth service failed: %s", httpResp.Status)
 	}
 
 	var resp authServiceResponse
 	decoder := json.NewDecoder(httpResp.Body)
-	err = decoder.Decode(&resp)
+	err := decoder.Decode(&resp)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to decode auth service response")
-	}
-
-	if resp.Certificate == "" || resp.PrivateKey == "" || resp.IssuingCACertificate == "" {
-		return nil, nil, errors.Errorf("auth service response was missing a required field: cert=%t, key=%t, ca=%t",
-			resp.Certificate != "", resp.PrivateKey != "", resp.IssuingCACertificate != "")
+		return nil, errors.Wrap(err, "failed to decode auth service response")
 	}
 
-	return p.loadFromResponse(resp)
+	return &resp, nil
 }
 
 func (p *AuthServiceCertProvider) loadFromResponse(response authServiceResponse) (*tls.Certificate, *x509.CertPool, error) {
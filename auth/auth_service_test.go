@@ -29,7 +29,9 @@ import (
 	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestAuthServiceCertProvider_ProvideCertificates_Success(t *testing.T) {
@@ -117,3 +119,55 @@ tls:
 	assert.Nil(t, certificate)
 	assert.Nil(t, certPool)
 }
+
+func TestAuthServiceCertProvider_ProvideCertificates_RetriesRejectedToken(t *testing.T) {
+	var identityRequests int32
+	identity := startKeystoneV2Issuer(time.Hour, &identityRequests)
+	defer identity.Close()
+
+	var authRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&authRequests, 1)
+		// such as when the token was revoked before its expiry
+		if req.Header.Get("X-Auth-Token") == "token-1" {
+			resp.WriteHeader(401)
+			return
+		}
+
+		resp.Header().Set("Content-Type", "application/json")
+		respFile, err := os.Open("testdata/auth_service_resp.json")
+		require.NoError(t, err)
+		defer respFile.Close()
+		io.Copy(resp, respFile)
+	}))
+	defer ts.Close()
+
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  auth_service:
+    url: %s
+    token_provider: TestAuthService_RetriesRejectedToken
+  token_providers:
+    keystone_v2:
+      username: user1
+      apikey: abc123
+      identityServiceUrl: %s
+`, ts.URL, identity.URL)))
+	require.NoError(t, err)
+
+	auth.RegisterAuthTokenProvider("TestAuthService_RetriesRejectedToken", func() (auth.AuthTokenProvider, error) {
+		return auth.NewKeystoneV2AuthTokenProvider()
+	})
+
+	_, _, err = auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&identityRequests))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authRequests))
+
+	// the accepted token is reused
+	_, _, err = auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&identityRequests))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&authRequests))
+}
@@ -20,16 +20,74 @@ package auth
 
 import (
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
 )
 
+// maxTokenRenewalMargin is the most time prior to expiry that a reused token is renewed
+const maxTokenRenewalMargin = 5 * time.Minute
+
 type AuthToken struct {
 	Headers map[string]string
+	// Expires is when the token is no longer accepted or zero if not known
+	Expires time.Time
 }
 
 type AuthTokenProvider interface {
 	ProvideAuthToken() (*AuthToken, error)
 }
 
+// RefreshableAuthTokenProvider is implemented by providers that reuse tokens until they expire
+type RefreshableAuthTokenProvider interface {
+	AuthTokenProvider
+	// InvalidateAuthToken ensures the next token is newly obtained, such as after a token was rejected
+	InvalidateAuthToken()
+}
+
+// authTokenCache retains the token of a provider until it is due for renewal. A token without a known
+// expiry is retained until invalidated.
+type authTokenCache struct {
+	mutex     sync.Mutex
+	token     *AuthToken
+	renewAt   time.Time
+	renewable bool
+}
+
+// get returns the retained token or one newly obtained from request
+func (c *authTokenCache) get(request func() (*AuthToken, error)) (*AuthToken, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token != nil && (!c.renewable || time.Now().Before(c.renewAt)) {
+		log.Debug("reusing auth token")
+		return c.token, nil
+	}
+
+	token, err := request()
+	if err != nil {
+		return nil, err
+	}
+
+	c.token = token
+	c.renewable = !token.Expires.IsZero()
+	if c.renewable {
+		// renew ahead of expiry, while allowing for short lived tokens to be reused at all
+		margin := time.Until(token.Expires) / 10
+		if margin > maxTokenRenewalMargin {
+			margin = maxTokenRenewalMargin
+		}
+		c.renewAt = token.Expires.Add(-margin)
+	}
+	return token, nil
+}
+
+func (c *authTokenCache) InvalidateAuthToken() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.token = nil
+}
+
 type AuthTokenProviderFactory func() (AuthTokenProvider, error)
 
 var (
@@ -19,10 +19,19 @@
 package auth_test
 
 import (
+	"fmt"
 	"github.com/pkg/errors"
 	"github.com/racker/telemetry-envoy/auth"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type TestAuthTokenProvider struct {
@@ -65,3 +74,92 @@ func TestGetAuthTokenProvider_InvalidName(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, result)
 }
+
+// startKeystoneV2Issuer stands in for keystone v2, issuing tokens numbered by request that
+// expire after the given lifetime
+func startKeystoneV2Issuer(lifetime time.Duration, requests *int32) *httptest.Server {
+	return httptest.NewServer(keystoneV2IssuerHandler(lifetime, requests))
+}
+
+func keystoneV2IssuerHandler(lifetime time.Duration, requests *int32) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		count := atomic.AddInt32(requests, 1)
+		resp.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(resp, `{"access":{"token":{"id":"token-%d","expires":"%s"}}}`,
+			count, time.Now().Add(lifetime).UTC().Format(time.RFC3339Nano))
+	})
+}
+
+func setupKeystoneV2Issuer(t *testing.T, url string) *auth.KeystoneV2AuthTokenProvider {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  token_providers:
+    keystone_v2:
+      username: user1
+      apikey: abc123
+      identityServiceUrl: %s
+`, url)))
+	require.NoError(t, err)
+
+	provider, err := auth.NewKeystoneV2AuthTokenProvider()
+	require.NoError(t, err)
+	return provider
+}
+
+func TestKeystoneV2AuthTokenProvider_ReusesToken(t *testing.T) {
+	var requests int32
+	ts := startKeystoneV2Issuer(time.Hour, &requests)
+	defer ts.Close()
+	provider := setupKeystoneV2Issuer(t, ts.URL)
+
+	token, err := provider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.Headers["X-Auth-Token"])
+	assert.WithinDuration(t, time.Now().Add(time.Hour), token.Expires, time.Minute)
+
+	token, err = provider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", token.Headers["X-Auth-Token"])
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	provider.InvalidateAuthToken()
+	token, err = provider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.Headers["X-Auth-Token"])
+}
+
+func TestKeystoneV2AuthTokenProvider_RenewsBeforeExpiry(t *testing.T) {
+	var requests int32
+	// already within the renewal margin of its expiry
+	ts := startKeystoneV2Issuer(-time.Second, &requests)
+	defer ts.Close()
+	provider := setupKeystoneV2Issuer(t, ts.URL)
+
+	_, err := provider.ProvideAuthToken()
+	require.NoError(t, err)
+	token, err := provider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", token.Headers["X-Auth-Token"])
+}
+
+func TestKeystoneV2AuthTokenProvider_ReusesConnection(t *testing.T) {
+	var requests, connections int32
+	ts := httptest.NewUnstartedServer(keystoneV2IssuerHandler(time.Hour, &requests))
+	ts.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	provider := setupKeystoneV2Issuer(t, ts.URL)
+
+	for i := 0; i < 3; i++ {
+		provider.InvalidateAuthToken()
+		_, err := provider.ProvideAuthToken()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections))
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// authCertsFilename is the file, within the data path, that caches the certificates issued by
+// the auth service
+const authCertsFilename = "auth-certs.json"
+
+func init() {
+	viper.SetDefault(config.TlsRenewalLifetimeFraction, 0.7)
+}
+
+// cachedCertificatesFile is the content of the cache file, which records how the certificates
+// were obtained so that they're not reused once the auth service config changes
+type cachedCertificatesFile struct {
+	authServiceResponse
+	Url  string `json:"url"`
+	Mode string `json:"mode"`
+}
+
+type cachedCertificates struct {
+	response authServiceResponse
+	// renewAt is when the certificate has reached the portion of its lifetime that warrants renewal
+	renewAt  time.Time
+	notAfter time.Time
+}
+
+func authCertsPath() string {
+	dataPath := viper.GetString(config.AgentsDataPath)
+	if dataPath == "" {
+		return ""
+	}
+	return filepath.Join(dataPath, authCertsFilename)
+}
+
+// loadCachedCertificates returns the previously issued certificates, if any are cached, not expired,
+// and were obtained with the current auth service config
+func loadCachedCertificates(tlsConfig *TlsConfig) *cachedCertificates {
+	certsPath := authCertsPath()
+	if certsPath == "" {
+		return nil
+	}
+
+	content, err := ioutil.ReadFile(certsPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", certsPath).Warn("unable to read cached certificates")
+		}
+		return nil
+	}
+
+	var file cachedCertificatesFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		log.WithError(err).WithField("path", certsPath).Warn("ignoring malformed cached certificates")
+		return nil
+	}
+	if file.Url != tlsConfig.AuthService.Url || file.Mode != tlsConfig.AuthService.Mode {
+		log.WithFields(log.Fields{
+			"url":  file.Url,
+			"mode": file.Mode,
+		}).Info("ignoring cached certificates obtained with a different auth service config")
+		return nil
+	}
+	cached := &cachedCertificates{response: file.authServiceResponse}
+
+	block, _ := pem.Decode([]byte(cached.response.Certificate))
+	if block == nil {
+		log.WithField("path", certsPath).Warn("ignoring cached certificates without a certificate")
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		log.WithError(err).WithField("path", certsPath).Warn("ignoring malformed cached certificate")
+		return nil
+	}
+
+	if !time.Now().Before(leaf.NotAfter) {
+		log.WithField("expired", leaf.NotAfter).Debug("cached certificate has expired")
+		return nil
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	fraction := viper.GetFloat64(config.TlsRenewalLifetimeFraction)
+	cached.renewAt = leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+	cached.notAfter = leaf.NotAfter
+	return cached
+}
+
+// saveCachedCertificates retains the issued certificates, which include the private key, so
+// they are only readable by the Envoy's user
+func saveCachedCertificates(tlsConfig *TlsConfig, resp *authServiceResponse) error {
+	certsPath := authCertsPath()
+	if certsPath == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(&cachedCertificatesFile{
+		authServiceResponse: *resp,
+		Url:                 tlsConfig.AuthService.Url,
+		Mode:                tlsConfig.AuthService.Mode,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to encode certificates")
+	}
+
+	err = os.MkdirAll(filepath.Dir(certsPath), 0755)
+	if err != nil {
+		return errors.Wrap(err, "failed to create data path")
+	}
+
+	// a stale temp file is removed, rather than reused, so that it's created with restricted permissions.
+	// It is synced before the rename, so that a crash can't leave behind a renamed, but empty, file.
+	tempPath := certsPath + ".tmp"
+	os.Remove(tempPath)
+	err = writeSyncedFile(tempPath, content, 0600)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to write certificates")
+	}
+	err = os.Rename(tempPath, certsPath)
+	if err != nil {
+		os.Remove(tempPath)
+		return errors.Wrap(err, "failed to replace cached certificates")
+	}
+
+	err = syncDir(filepath.Dir(certsPath))
+	if err != nil {
+		return errors.Wrap(err, "failed to sync cached certificates directory")
+	}
+	return nil
+}
+
+// writeSyncedFile creates the file, which must not already exist, and flushes its content to disk
+func writeSyncedFile(filename string, content []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer file.Close()
+
+	_, err = file.Write(content)
+	if err != nil {
+		return err
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// syncDir flushes the directory entries, such as a newly renamed child, to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	//noinspection GoUnhandledErrorResult
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// DiscardCachedCertificates removes the cached certificates, such as after they were rejected,
+// so that new certificates are requested from the auth service
+func DiscardCachedCertificates() {
+	certsPath := authCertsPath()
+	if certsPath == "" {
+		return
+	}
+
+	err := os.Remove(certsPath)
+	if err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("path", certsPath).Warn("failed to remove cached certificates")
+	}
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// issuingAuthService responds with self-signed certificates valid from notBefore to notAfter,
+// or fails when failing is non-zero
+type issuingAuthService struct {
+	notBefore time.Time
+	notAfter  time.Time
+	requests  int32
+	failing   int32
+}
+
+func (s *issuingAuthService) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	atomic.AddInt32(&s.requests, 1)
+	if atomic.LoadInt32(&s.failing) != 0 {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "cached-envoy"},
+		NotBefore:             s.notBefore,
+		NotAfter:              s.notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	certPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}))
+
+	resp.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(resp).Encode(map[string]string{
+		"certificate":          certPem,
+		"privateKey":           string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})),
+		"issuingCaCertificate": certPem,
+	})
+}
+
+func readAuthServiceConfig(t *testing.T, url string) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  auth_service:
+    url: %s
+    token_provider: test
+`, url)))
+	require.NoError(t, err)
+}
+
+func setupCertCacheTest(t *testing.T, authService *issuingAuthService) (*httptest.Server, string) {
+	ts := httptest.NewServer(authService)
+
+	dataPath, err := ioutil.TempDir("", "test_auth")
+	require.NoError(t, err)
+	viper.Set(config.AgentsDataPath, dataPath)
+
+	readAuthServiceConfig(t, ts.URL)
+
+	auth.RegisterAuthTokenProvider("test", func() (auth.AuthTokenProvider, error) {
+		return &TestAuthTokenProvider{Header: "X-Auth-Token", Token: "token-1"}, nil
+	})
+
+	return ts, dataPath
+}
+
+func TestAuthServiceCertProvider_CachesCertificates(t *testing.T) {
+	authService := &issuingAuthService{
+		notBefore: time.Now().Add(-time.Hour),
+		notAfter:  time.Now().Add(23 * time.Hour),
+	}
+	ts, dataPath := setupCertCacheTest(t, authService)
+	defer ts.Close()
+	defer os.RemoveAll(dataPath)
+	defer viper.Set(config.AgentsDataPath, "")
+
+	certificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	verifyCertSubject(t, "cached-envoy", certificate)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authService.requests))
+
+	info, err := os.Stat(filepath.Join(dataPath, "auth-certs.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// such as when starting up while the auth service is down
+	atomic.StoreInt32(&authService.failing, 1)
+	cachedCertificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, certificate.Certificate, cachedCertificate.Certificate)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authService.requests))
+
+	// after the certificate was rejected
+	auth.DiscardCachedCertificates()
+	_, _, err = auth.LoadCertificates()
+	assert.Error(t, err)
+	// the failed request was also retried
+	assert.Equal(t, int32(5), atomic.LoadInt32(&authService.requests))
+}
+
+func TestAuthServiceCertProvider_RenewsCachedCertificateNearExpiry(t *testing.T) {
+	authService := &issuingAuthService{
+		notBefore: time.Now().Add(-23 * time.Hour),
+		notAfter:  time.Now().Add(time.Hour),
+	}
+	ts, dataPath := setupCertCacheTest(t, authService)
+	defer ts.Close()
+	defer os.RemoveAll(dataPath)
+	defer viper.Set(config.AgentsDataPath, "")
+
+	certificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+
+	renewedCertificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.NotEqual(t, certificate.Certificate, renewedCertificate.Certificate)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&authService.requests))
+
+	// the cached certificate is still usable while the auth service is down
+	atomic.StoreInt32(&authService.failing, 1)
+	cachedCertificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.Equal(t, renewedCertificate.Certificate, cachedCertificate.Certificate)
+	// the failed request was also retried
+	assert.Equal(t, int32(6), atomic.LoadInt32(&authService.requests))
+}
+
+func TestAuthServiceCertProvider_IgnoresCacheFromOtherAuthService(t *testing.T) {
+	authService := &issuingAuthService{
+		notBefore: time.Now().Add(-time.Hour),
+		notAfter:  time.Now().Add(23 * time.Hour),
+	}
+	ts, dataPath := setupCertCacheTest(t, authService)
+	defer ts.Close()
+	defer os.RemoveAll(dataPath)
+	defer viper.Set(config.AgentsDataPath, "")
+
+	certificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+
+	otherAuthService := &issuingAuthService{
+		notBefore: time.Now().Add(-time.Hour),
+		notAfter:  time.Now().Add(23 * time.Hour),
+	}
+	otherTs := httptest.NewServer(otherAuthService)
+	defer otherTs.Close()
+	readAuthServiceConfig(t, otherTs.URL)
+
+	otherCertificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	assert.NotEqual(t, certificate.Certificate, otherCertificate.Certificate)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&authService.requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&otherAuthService.requests))
+
+	// switching back doesn't fall back to the certificates from the other auth service
+	atomic.StoreInt32(&otherAuthService.failing, 1)
+	readAuthServiceConfig(t, ts.URL)
+	atomic.StoreInt32(&authService.failing, 1)
+	_, _, err = auth.LoadCertificates()
+	assert.Error(t, err)
+}
+
+func TestAuthServiceCertProvider_StaleTempFile(t *testing.T) {
+	authService := &issuingAuthService{
+		notBefore: time.Now().Add(-time.Hour),
+		notAfter:  time.Now().Add(23 * time.Hour),
+	}
+	ts, dataPath := setupCertCacheTest(t, authService)
+	defer ts.Close()
+	defer os.RemoveAll(dataPath)
+	defer viper.Set(config.AgentsDataPath, "")
+
+	// such as left behind by a crash during a previous save
+	err := ioutil.WriteFile(filepath.Join(dataPath, "auth-certs.json.tmp"), []byte("partial"), 0644)
+	require.NoError(t, err)
+
+	_, _, err = auth.LoadCertificates()
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(dataPath, "auth-certs.json"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dataPath, "auth-certs.json.tmp"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// AuthServiceModeCsr has the auth service sign a certificate request for a key that never
+	// leaves the host
+	AuthServiceModeCsr = "csr"
+
+	KeyTypeEcdsa = "ecdsa"
+	KeyTypeRsa   = "rsa"
+
+	rsaKeyBits = 2048
+)
+
+type authServiceCsrRequest struct {
+	Csr        string            `json:"csr"`
+	ResourceId string            `json:"resourceId"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// requestSignedCertificate generates a private key and obtains a certificate for it from the
+// auth service. Only the certificate signing request is sent to the auth service.
+func (p *AuthServiceCertProvider) requestSignedCertificate(tlsConfig *TlsConfig) (*authServiceResponse, error) {
+	log.WithField("config", tlsConfig.AuthService).Debug("requesting signed certificate from auth service")
+
+	resourceId := viper.GetString(config.ResourceId)
+	labels, err := config.ComputeLabels()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to compute labels for certificate request")
+	}
+
+	key, keyPem, err := generatePrivateKey(tlsConfig.AuthService.KeyType)
+	if err != nil {
+		return nil, err
+	}
+
+	csrDer, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: resourceId},
+	}, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create certificate request")
+	}
+
+	resp, err := p.callAuthService(tlsConfig, "POST", "auth/csr", &authServiceCsrRequest{
+		Csr:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDer})),
+		ResourceId: resourceId,
+		Labels:     labels,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Certificate == "" || resp.IssuingCACertificate == "" {
+		return nil, errors.Errorf("auth service response was missing a required field: cert=%t, ca=%t",
+			resp.Certificate != "", resp.IssuingCACertificate != "")
+	}
+	if resp.PrivateKey != "" {
+		log.Warn("ignoring private key returned by auth service in csr mode")
+	}
+
+	block, _ := pem.Decode([]byte(resp.Certificate))
+	if block == nil {
+		return nil, errors.New("auth service response did not contain a PEM certificate")
+	}
+	certificate, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse signed certificate")
+	}
+	publicKey, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !publicKey.Equal(certificate.PublicKey) {
+		return nil, errors.New("signed certificate does not match the generated key")
+	}
+
+	resp.PrivateKey = string(keyPem)
+	return resp, nil
+}
+
+// generatePrivateKey creates a key of the given type and also returns its PEM encoding
+func generatePrivateKey(keyType string) (crypto.Signer, []byte, error) {
+	switch keyType {
+	case KeyTypeEcdsa, "":
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to generate ECDSA key")
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to encode ECDSA key")
+		}
+		return key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+
+	case KeyTypeRsa:
+		key, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to generate RSA key")
+		}
+		der := x509.MarshalPKCS1PrivateKey(key)
+		return key, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der}), nil
+
+	default:
+		return nil, nil, errors.Errorf("unsupported key type: %s", keyType)
+	}
+}
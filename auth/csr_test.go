@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSigningAuthService stands in for an auth service that signs certificate requests
+func startSigningAuthService(t *testing.T) *httptest.Server {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDer)
+	require.NoError(t, err)
+
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "/auth/csr", req.URL.Path)
+		assert.Equal(t, "token-1", req.Header.Get("X-Auth-Token"))
+
+		body, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		assert.NotContains(t, string(body), "PRIVATE KEY")
+
+		var csrReq struct {
+			Csr        string
+			ResourceId string
+			Labels     map[string]string
+		}
+		require.NoError(t, json.Unmarshal(body, &csrReq))
+		assert.Equal(t, "type:value", csrReq.ResourceId)
+		assert.NotEmpty(t, csrReq.Labels[config.HostnameLabel])
+
+		block, _ := pem.Decode([]byte(csrReq.Csr))
+		require.NotNil(t, block)
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		require.NoError(t, err)
+		require.NoError(t, csr.CheckSignature())
+
+		certDer, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, caCert, csr.PublicKey, caKey)
+		require.NoError(t, err)
+
+		resp.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(resp).Encode(map[string]string{
+			"certificate":          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer})),
+			"issuingCaCertificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer})),
+		})
+	}))
+}
+
+func TestAuthServiceCertProvider_ProvideCertificates_Csr(t *testing.T) {
+	ts := startSigningAuthService(t)
+	defer ts.Close()
+
+	auth.RegisterAuthTokenProvider("test", func() (auth.AuthTokenProvider, error) {
+		return &TestAuthTokenProvider{Header: "X-Auth-Token", Token: "token-1"}, nil
+	})
+	viper.Set(config.ResourceId, "type:value")
+	defer viper.Set(config.ResourceId, "")
+
+	for _, keyType := range []string{auth.KeyTypeEcdsa, auth.KeyTypeRsa} {
+		viper.SetConfigType("yaml")
+		err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  auth_service:
+    url: %s
+    token_provider: test
+    mode: csr
+    key_type: %s
+`, ts.URL, keyType)))
+		require.NoError(t, err)
+
+		certificate, certPool, err := auth.LoadCertificates()
+		require.NoError(t, err, keyType)
+
+		verifyCertSubject(t, "type:value", certificate)
+		verifyCertPoolSubject(t, "test-ca", certPool)
+		switch keyType {
+		case auth.KeyTypeEcdsa:
+			assert.IsType(t, &ecdsa.PrivateKey{}, certificate.PrivateKey)
+		case auth.KeyTypeRsa:
+			assert.IsType(t, &rsa.PrivateKey{}, certificate.PrivateKey)
+		}
+	}
+}
+
+func TestAuthServiceCertProvider_ProvideCertificates_CsrUnknownKeyType(t *testing.T) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(`
+tls:
+  auth_service:
+    url: http://localhost:1
+    token_provider: test
+    mode: csr
+    key_type: dsa
+`))
+	require.NoError(t, err)
+
+	_, _, err = auth.LoadCertificates()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unsupported key type")
+}
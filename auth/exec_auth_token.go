@@ -0,0 +1,151 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	execConfigKey = "tls.token_providers.exec"
+	// maxExecStderrLength limits how much of the command's error output is included in errors
+	maxExecStderrLength = 1024
+	// execWaitDelay bounds how long output is awaited after the command is killed, such as when
+	// a child process of the command still holds it open
+	execWaitDelay = time.Second
+)
+
+// ExecAuthTokenProvider obtains auth headers from the output of a credential helper command
+type ExecAuthTokenProvider struct {
+	authTokenCache
+	config *ExecAuthTokenConfig
+}
+
+// ExecAuthTokenConfig is populated from the viper config key "tls.token_providers.exec"
+type ExecAuthTokenConfig struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// execAuthTokenOutput is the JSON written to stdout by the command, where expires is
+// an optional RFC 3339 timestamp
+type execAuthTokenOutput struct {
+	Headers map[string]string `json:"headers"`
+	Expires string            `json:"expires"`
+}
+
+func init() {
+	viper.SetDefault(execConfigKey+".timeout", 30*time.Second)
+
+	RegisterAuthTokenProvider("exec", func() (AuthTokenProvider, error) {
+		return NewExecAuthTokenProvider()
+	})
+}
+
+// NewExecAuthTokenProvider requires a positive timeout since a credential helper that never
+// completes would otherwise block the Envoy from ever obtaining certificates.
+func NewExecAuthTokenProvider() (*ExecAuthTokenProvider, error) {
+	config := &ExecAuthTokenConfig{
+		Command: viper.GetString(execConfigKey + ".command"),
+		Args:    viper.GetStringSlice(execConfigKey + ".args"),
+		Timeout: viper.GetDuration(execConfigKey + ".timeout"),
+	}
+	if config.Timeout <= 0 {
+		return nil, errors.Errorf("timeout in %s config must be positive, but was %s",
+			execConfigKey, config.Timeout)
+	}
+
+	return &ExecAuthTokenProvider{
+		config: config,
+	}, nil
+}
+
+// ProvideAuthToken reuses the previous headers until they are about to expire
+func (p *ExecAuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
+	return p.get(p.runCommand)
+}
+
+func (p *ExecAuthTokenProvider) runCommand() (*AuthToken, error) {
+	if p.config.Command == "" {
+		return nil, errors.New("command needs to be set in tls.token_providers.exec config")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.config.Command, p.config.Args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = execWaitDelay
+
+	log.WithField("command", p.config.Command).Debug("running credential helper")
+	err := cmd.Run()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			err = errors.Errorf("timed out after %s", p.config.Timeout)
+		}
+		return nil, errors.Wrap(err, withStderr("credential helper failed", stderr.String()))
+	}
+
+	var output execAuthTokenOutput
+	err = json.Unmarshal(stdout.Bytes(), &output)
+	if err != nil {
+		return nil, errors.Wrap(err, withStderr("failed to decode credential helper output", stderr.String()))
+	}
+	if len(output.Headers) == 0 {
+		return nil, errors.New(withStderr("credential helper output did not include any headers", stderr.String()))
+	}
+
+	token := &AuthToken{Headers: output.Headers}
+	if output.Expires != "" {
+		token.Expires, err = time.Parse(time.RFC3339, output.Expires)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse expiry of credential helper output")
+		}
+	}
+
+	log.WithField("expires", token.Expires).Debug("acquired auth headers from credential helper")
+	return token, nil
+}
+
+// withStderr appends the credential helper's stderr, if any, to the message since it usually
+// explains why the helper didn't produce a token
+func withStderr(message string, stderr string) string {
+	stderr = truncateStderr(stderr)
+	if stderr == "" {
+		return message
+	}
+	return message + ": " + stderr
+}
+
+func truncateStderr(stderr string) string {
+	stderr = strings.TrimSpace(stderr)
+	if len(stderr) > maxExecStderrLength {
+		return stderr[:maxExecStderrLength] + "..."
+	}
+	return stderr
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"fmt"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setupExecAuthTokenProvider(t *testing.T, script string, timeout string) *auth.ExecAuthTokenProvider {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  token_providers:
+    exec:
+      command: sh
+      args:
+        - -c
+        - %q
+      timeout: %s
+`, script, timeout)))
+	require.NoError(t, err)
+
+	provider, err := auth.NewExecAuthTokenProvider()
+	require.NoError(t, err)
+	return provider
+}
+
+func TestExecAuthTokenProvider_ProvideAuthToken_Normal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_exec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	expires := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	provider := setupExecAuthTokenProvider(t, fmt.Sprintf(
+		`echo run >> %s; echo '{"headers":{"X-Auth-Token":"secret-1","X-Tenant":"t1"},"expires":"%s"}'`,
+		runs, expires), "5s")
+
+	token, err := provider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"X-Auth-Token": "secret-1", "X-Tenant": "t1"}, token.Headers)
+	assert.Equal(t, expires, token.Expires.Format(time.RFC3339))
+
+	_, err = provider.ProvideAuthToken()
+	require.NoError(t, err)
+	content, err := ioutil.ReadFile(runs)
+	require.NoError(t, err)
+	assert.Equal(t, "run\n", string(content), "headers should have been reused")
+}
+
+func TestExecAuthTokenProvider_ProvideAuthToken_Failures(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected string
+	}{
+		{"exit status", `echo 'vault is sealed' >&2; exit 3`, "vault is sealed"},
+		{"malformed output", `echo 'not json'`, "decode"},
+		{"no headers", `echo '{"headers":{}}'`, "headers"},
+		{"malformed output with stderr", `echo 'token expired, run login' >&2; echo 'not json'`, "token expired, run login"},
+		{"no headers with stderr", `echo 'no token cached' >&2; echo '{"headers":{}}'`, "no token cached"},
+		{"timeout", `sleep 5`, "timed out"},
+	}
+	for _, tt := range tests {
+		provider := setupExecAuthTokenProvider(t, tt.script, "200ms")
+
+		_, err := provider.ProvideAuthToken()
+		require.Error(t, err, tt.name)
+		assert.Contains(t, err.Error(), tt.expected, tt.name)
+	}
+}
+
+func TestNewExecAuthTokenProvider_InvalidTimeout(t *testing.T) {
+	for _, timeout := range []string{"0s", "-1s"} {
+		viper.SetConfigType("yaml")
+		err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  token_providers:
+    exec:
+      command: true
+      timeout: %s
+`, timeout)))
+		require.NoError(t, err)
+
+		_, err = auth.NewExecAuthTokenProvider()
+		assert.Error(t, err, timeout)
+	}
+}
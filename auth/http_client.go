@@ -0,0 +1,229 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/cenkalti/backoff"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/netproxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const authClientConfigKey = "tls.auth_client"
+
+// AuthClientConfig is populated from the viper config key "tls.auth_client" and configures the
+// HTTP client used for requests to the auth service and by the token providers
+type AuthClientConfig struct {
+	// Ca is a PEM file of CA certificates to trust in addition to the system's certificates
+	Ca string
+	// Cert and Key are PEM files of a client certificate to present to the servers
+	Cert, Key      string
+	ConnectTimeout time.Duration `mapstructure:"connect_timeout"`
+	// ResponseTimeout is how long each attempt waits for the response headers
+	ResponseTimeout time.Duration `mapstructure:"response_timeout"`
+	// Timeout bounds each request overall, including retries and reading the response
+	Timeout    time.Duration
+	Retries    int
+	RetryDelay time.Duration `mapstructure:"retry_delay"`
+}
+
+func init() {
+	viper.SetDefault(authClientConfigKey+".connect_timeout", 10*time.Second)
+	viper.SetDefault(authClientConfigKey+".response_timeout", 30*time.Second)
+	viper.SetDefault(authClientConfigKey+".timeout", 2*time.Minute)
+	viper.SetDefault(authClientConfigKey+".retries", 3)
+	viper.SetDefault(authClientConfigKey+".retry_delay", 1*time.Second)
+}
+
+// newHttpClient creates the client used for requests to the auth service and by the token
+// providers. It goes through the same proxy as the Ambassador connection, when one is configured.
+func newHttpClient() (*http.Client, error) {
+	clientConfig := &AuthClientConfig{
+		Ca:              viper.GetString(authClientConfigKey + ".ca"),
+		Cert:            viper.GetString(authClientConfigKey + ".cert"),
+		Key:             viper.GetString(authClientConfigKey + ".key"),
+		ConnectTimeout:  viper.GetDuration(authClientConfigKey + ".connect_timeout"),
+		ResponseTimeout: viper.GetDuration(authClientConfigKey + ".response_timeout"),
+		Timeout:         viper.GetDuration(authClientConfigKey + ".timeout"),
+		Retries:         viper.GetInt(authClientConfigKey + ".retries"),
+		RetryDelay:      viper.GetDuration(authClientConfigKey + ".retry_delay"),
+	}
+
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   clientConfig.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   clientConfig.ConnectTimeout,
+		ResponseHeaderTimeout: clientConfig.ResponseTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	proxyConfig, err := netproxy.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if proxyConfig != nil {
+		transport.Proxy = proxyConfig.HttpProxy
+	}
+
+	transport.TLSClientConfig, err = clientConfig.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Transport: &retryingRoundTripper{
+			next:       transport,
+			retries:    clientConfig.Retries,
+			retryDelay: clientConfig.RetryDelay,
+		},
+		Timeout: clientConfig.Timeout,
+	}, nil
+}
+
+// authHttpClient retains the HTTP client of a provider, so that its connections are reused
+// across requests. The client is created on first use.
+type authHttpClient struct {
+	clientMutex sync.Mutex
+	client      *http.Client
+}
+
+// httpClient returns the retained client or a newly created one
+func (c *authHttpClient) httpClient() (*http.Client, error) {
+	c.clientMutex.Lock()
+	defer c.clientMutex.Unlock()
+
+	if c.client == nil {
+		client, err := newHttpClient()
+		if err != nil {
+			return nil, err
+		}
+		c.client = client
+	}
+	return c.client, nil
+}
+
+func (c *AuthClientConfig) tlsConfig() (*tls.Config, error) {
+	if c.Ca == "" && c.Cert == "" {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{}
+
+	if c.Ca != "" {
+		caPem, err := ioutil.ReadFile(c.Ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to read auth client CA file")
+		}
+
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			log.WithError(err).Debug("system cert pool unavailable, using only auth client CA file")
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caPem) {
+			return nil, errors.Errorf("no certificates found in auth client CA file: %s", c.Ca)
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	if c.Cert != "" {
+		certificate, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load auth client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// retryingRoundTripper retries requests that failed due to a network error or a server error
+// response. Once the retries are exhausted, the last server error response is returned as is.
+type retryingRoundTripper struct {
+	next       http.RoundTripper
+	retries    int
+	retryDelay time.Duration
+}
+
+func (rt *retryingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		// the request can't be sent again
+		return rt.next.RoundTrip(req)
+	}
+
+	var resp *http.Response
+	err := backoff.RetryNotify(func() error {
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+
+		attempt := req
+		if req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return backoff.Permanent(errors.Wrap(err, "failed to replay request body"))
+			}
+			attempt = req.Clone(req.Context())
+			attempt.Body = body
+		}
+
+		attemptResp, err := rt.next.RoundTrip(attempt)
+		if err != nil {
+			return err
+		}
+		resp = attemptResp
+		if resp.StatusCode >= 500 {
+			return errors.Errorf("server responded with %s", resp.Status)
+		}
+		return nil
+	}, backoff.WithContext(rt.newBackOff(), req.Context()),
+		func(err error, delay time.Duration) {
+			log.WithError(err).WithFields(log.Fields{
+				"url":   req.URL.Redacted(),
+				"delay": delay,
+			}).Warn("auth request failed, will retry")
+		})
+
+	if resp != nil {
+		return resp, nil
+	}
+	return nil, err
+}
+
+func (rt *retryingRoundTripper) newBackOff() backoff.BackOff {
+	if rt.retries <= 0 {
+		// since zero max retries would otherwise mean unlimited
+		return &backoff.StopBackOff{}
+	}
+
+	exponential := backoff.NewExponentialBackOff()
+	exponential.InitialInterval = rt.retryDelay
+	// the number of retries bounds the overall effort instead
+	exponential.MaxElapsedTime = 0
+	return backoff.WithMaxRetries(exponential, uint64(rt.retries))
+}
@@ -0,0 +1,173 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func serveAuthServiceResp(t *testing.T, resp http.ResponseWriter) {
+	resp.Header().Set("Content-Type", "application/json")
+
+	respFile, err := os.Open("testdata/auth_service_resp.json")
+	require.NoError(t, err)
+	defer respFile.Close()
+
+	io.Copy(resp, respFile)
+}
+
+func readAuthClientConfig(t *testing.T, url string, authClient string) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(fmt.Sprintf(`
+tls:
+  auth_service:
+    url: %s
+    token_provider: test
+  auth_client:
+%s
+`, url, authClient)))
+	require.NoError(t, err)
+
+	auth.RegisterAuthTokenProvider("test", func() (auth.AuthTokenProvider, error) {
+		return &TestAuthTokenProvider{Header: "X-Auth-Token", Token: "token-1"}, nil
+	})
+}
+
+func TestAuthClient_RetriesServerErrors(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		serveAuthServiceResp(t, resp)
+	}))
+	defer ts.Close()
+
+	readAuthClientConfig(t, ts.URL, `
+    retries: 2
+    retry_delay: 1ms
+`)
+
+	certificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	verifyCertSubject(t, "dev-ambassador", certificate)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// once the retries are exhausted
+	atomic.StoreInt32(&requests, 0)
+	readAuthClientConfig(t, ts.URL, `
+    retries: 1
+    retry_delay: 1ms
+`)
+
+	_, _, err = auth.LoadCertificates()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestAuthClient_ClientCertificateAndCa(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		require.NotNil(t, req.TLS)
+		require.Len(t, req.TLS.PeerCertificates, 1)
+		assert.Equal(t, "aaaaaa", req.TLS.PeerCertificates[0].Subject.CommonName)
+
+		serveAuthServiceResp(t, resp)
+	}))
+	// the test client certificate has since expired, so only its presence is required
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "test_auth_client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caFile := path.Join(dir, "ca.pem")
+	err = ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	require.NoError(t, err)
+
+	// without the CA, the server isn't trusted
+	readAuthClientConfig(t, ts.URL, `
+    retries: 0
+`)
+	_, _, err = auth.LoadCertificates()
+	require.Error(t, err)
+
+	readAuthClientConfig(t, ts.URL, fmt.Sprintf(`
+    ca: %s
+    cert: testdata/client.pem
+    key: testdata/client-key.pem
+    retries: 0
+`, caFile))
+	certificate, _, err := auth.LoadCertificates()
+	require.NoError(t, err)
+	verifyCertSubject(t, "dev-ambassador", certificate)
+}
+
+func TestAuthClient_BadCaFile(t *testing.T) {
+	readAuthClientConfig(t, "http://localhost", `
+    ca: testdata/auth_service_resp.json
+`)
+
+	_, _, err := auth.LoadCertificates()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no certificates found")
+}
+
+func TestAuthClient_ResponseTimeout(t *testing.T) {
+	var requests int32
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-done:
+		case <-req.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(done)
+
+	readAuthClientConfig(t, ts.URL, `
+    response_timeout: 50ms
+    retries: 1
+    retry_delay: 1ms
+`)
+
+	start := time.Now()
+	_, _, err := auth.LoadCertificates()
+	require.Error(t, err)
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
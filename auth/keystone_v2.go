@@ -26,11 +26,13 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"io/ioutil"
-	"net/http"
 	"text/template"
+	"time"
 )
 
 type KeystoneV2AuthTokenProvider struct {
+	authTokenCache
+	authHttpClient
 	config *KeystoneV2Config
 }
 
@@ -76,7 +78,12 @@ func NewKeystoneV2AuthTokenProvider() (*KeystoneV2AuthTokenProvider, error) {
 	}, nil
 }
 
+// ProvideAuthToken reuses the previous token until it is about to expire
 func (p *KeystoneV2AuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
+	return p.get(p.requestAuthToken)
+}
+
+func (p *KeystoneV2AuthTokenProvider) requestAuthToken() (*AuthToken, error) {
 
 	if p.config.IdentityServiceUrl == "" || p.config.Username == "" || p.config.Apikey == "" {
 		return nil, errors.New("identityServiceUrl, username, and apikey need to be set in tls.keystone_v2 config")
@@ -100,7 +107,11 @@ func (p *KeystoneV2AuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
 
 	log.WithField("url", fullUrl).Debug("acquiring keystone v2 authentication token")
 
-	resp, err := http.Post(fullUrl, "application/json", &postBody)
+	client, err := p.httpClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create identity service client")
+	}
+	resp, err := client.Post(fullUrl, "application/json", &postBody)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to post request for token")
 	}
@@ -127,11 +138,31 @@ func (p *KeystoneV2AuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
 	}
 
 	if tokenId, ok := resTokenId.(string); ok {
-		log.Debug("acquired keystone v2 authentication token")
+		expires := keystoneTokenExpiry(respJson, "$.access.token.expires")
+		log.WithField("expires", expires).Debug("acquired keystone v2 authentication token")
 		return &AuthToken{
 			Headers: map[string]string{"X-Auth-Token": tokenId},
+			Expires: expires,
 		}, nil
 	} else {
 		return nil, errors.New("failed to locate tokenId in response json")
 	}
 }
+
+// keystoneTokenExpiry extracts the expiry of a token from the response at the given json path.
+// Returns a zero time when the expiry is not available.
+func keystoneTokenExpiry(respJson interface{}, path string) time.Time {
+	resExpires, err := jsonpath.JsonPathLookup(respJson, path)
+	if err != nil {
+		log.WithError(err).Debug("keystone response did not include token expiry")
+		return time.Time{}
+	}
+
+	expiresStr, _ := resExpires.(string)
+	expires, err := time.Parse(time.RFC3339, expiresStr)
+	if err != nil {
+		log.WithError(err).Warn("unable to parse expiry of keystone token")
+		return time.Time{}
+	}
+	return expires
+}
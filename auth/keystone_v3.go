@@ -0,0 +1,276 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"time"
+)
+
+const keystoneV3ConfigKey = "tls.token_providers.keystone_v3"
+
+type KeystoneV3AuthTokenProvider struct {
+	authTokenCache
+	authHttpClient
+	config *KeystoneV3Config
+}
+
+// KeystoneV3Config is populated from the viper config key "tls.token_providers.keystone_v3".
+// Authentication uses an application credential when one is identified, otherwise a password.
+type KeystoneV3Config struct {
+	IdentityServiceUrl string
+
+	UserId         string
+	Username       string
+	UserDomainId   string
+	UserDomainName string
+	Password       string
+
+	ApplicationCredentialId     string
+	ApplicationCredentialName   string
+	ApplicationCredentialSecret string
+
+	// The optional scope of the token, which is either a project or a domain. Application
+	// credentials are already scoped to the project where they were created.
+	ProjectId         string
+	ProjectName       string
+	ProjectDomainId   string
+	ProjectDomainName string
+	DomainId          string
+	DomainName        string
+}
+
+type keystoneV3Domain struct {
+	Id   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type keystoneV3User struct {
+	Id       string            `json:"id,omitempty"`
+	Name     string            `json:"name,omitempty"`
+	Domain   *keystoneV3Domain `json:"domain,omitempty"`
+	Password string            `json:"password,omitempty"`
+}
+
+type keystoneV3ApplicationCredential struct {
+	Id     string          `json:"id,omitempty"`
+	Name   string          `json:"name,omitempty"`
+	User   *keystoneV3User `json:"user,omitempty"`
+	Secret string          `json:"secret"`
+}
+
+type keystoneV3Project struct {
+	Id     string            `json:"id,omitempty"`
+	Name   string            `json:"name,omitempty"`
+	Domain *keystoneV3Domain `json:"domain,omitempty"`
+}
+
+type keystoneV3Scope struct {
+	Project *keystoneV3Project `json:"project,omitempty"`
+	Domain  *keystoneV3Domain  `json:"domain,omitempty"`
+}
+
+type keystoneV3Identity struct {
+	Methods  []string `json:"methods"`
+	Password *struct {
+		User *keystoneV3User `json:"user"`
+	} `json:"password,omitempty"`
+	ApplicationCredential *keystoneV3ApplicationCredential `json:"application_credential,omitempty"`
+}
+
+type keystoneV3TokensRequest struct {
+	Auth struct {
+		Identity keystoneV3Identity `json:"identity"`
+		Scope    *keystoneV3Scope   `json:"scope,omitempty"`
+	} `json:"auth"`
+}
+
+func init() {
+	err := viper.BindEnv(keystoneV3ConfigKey+".password", "ENVOY_KEYSTONE_V3_PASSWORD")
+	if err != nil {
+		log.WithError(err).Fatal("failed to bind KEYSTONE_V3_PASSWORD")
+	}
+	err = viper.BindEnv(keystoneV3ConfigKey+".applicationCredentialSecret", "ENVOY_KEYSTONE_V3_APPLICATION_CREDENTIAL_SECRET")
+	if err != nil {
+		log.WithError(err).Fatal("failed to bind KEYSTONE_V3_APPLICATION_CREDENTIAL_SECRET")
+	}
+
+	RegisterAuthTokenProvider("keystone_v3", func() (AuthTokenProvider, error) {
+		return NewKeystoneV3AuthTokenProvider()
+	})
+}
+
+func NewKeystoneV3AuthTokenProvider() (*KeystoneV3AuthTokenProvider, error) {
+	get := func(field string) string {
+		return viper.GetString(keystoneV3ConfigKey + "." + field)
+	}
+
+	return &KeystoneV3AuthTokenProvider{
+		config: &KeystoneV3Config{
+			IdentityServiceUrl:          get("identityServiceUrl"),
+			UserId:                      get("userId"),
+			Username:                    get("username"),
+			UserDomainId:                get("userDomainId"),
+			UserDomainName:              get("userDomainName"),
+			Password:                    get("password"),
+			ApplicationCredentialId:     get("applicationCredentialId"),
+			ApplicationCredentialName:   get("applicationCredentialName"),
+			ApplicationCredentialSecret: get("applicationCredentialSecret"),
+			ProjectId:                   get("projectId"),
+			ProjectName:                 get("projectName"),
+			ProjectDomainId:             get("projectDomainId"),
+			ProjectDomainName:           get("projectDomainName"),
+			DomainId:                    get("domainId"),
+			DomainName:                  get("domainName"),
+		},
+	}, nil
+}
+
+// ProvideAuthToken reuses the previous token until it is about to expire
+func (p *KeystoneV3AuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
+	return p.get(p.requestAuthToken)
+}
+
+func (p *KeystoneV3AuthTokenProvider) requestAuthToken() (*AuthToken, error) {
+	tokensRequest, err := p.buildTokensRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	postBody, err := json.Marshal(tokensRequest)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build token post body")
+	}
+
+	fullUrl, err := AppendUrlPath(p.config.IdentityServiceUrl, "auth/tokens")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build request url")
+	}
+
+	log.WithField("url", fullUrl).Debug("acquiring keystone v3 authentication token")
+
+	client, err := p.httpClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create identity service client")
+	}
+	resp, err := client.Post(fullUrl, "application/json", bytes.NewReader(postBody))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to post request for token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 201 {
+		return nil, errors.Errorf("tokens web request to keystone v3 failed: %s", resp.Status)
+	}
+
+	tokenId := resp.Header.Get("X-Subject-Token")
+	if tokenId == "" {
+		return nil, errors.New("keystone v3 response is missing the X-Subject-Token header")
+	}
+
+	var respJson interface{}
+	expires := time.Time{}
+	err = json.NewDecoder(resp.Body).Decode(&respJson)
+	if err != nil {
+		log.WithError(err).Warn("unable to decode keystone v3 token response")
+	} else {
+		expires = keystoneTokenExpiry(respJson, "$.token.expires_at")
+	}
+
+	log.WithField("expires", expires).Debug("acquired keystone v3 authentication token")
+	return &AuthToken{
+		Headers: map[string]string{"X-Auth-Token": tokenId},
+		Expires: expires,
+	}, nil
+}
+
+func (p *KeystoneV3AuthTokenProvider) buildTokensRequest() (*keystoneV3TokensRequest, error) {
+	c := p.config
+	if c.IdentityServiceUrl == "" {
+		return nil, errors.New("identityServiceUrl needs to be set in tls.token_providers.keystone_v3 config")
+	}
+
+	var user *keystoneV3User
+	if c.UserId != "" || c.Username != "" {
+		user = &keystoneV3User{Id: c.UserId, Name: c.Username}
+		if c.UserId == "" {
+			// a user name is only unique within a domain
+			if c.UserDomainId == "" && c.UserDomainName == "" {
+				return nil, errors.New("userDomainId or userDomainName needs to be set along with username")
+			}
+			user.Domain = &keystoneV3Domain{Id: c.UserDomainId, Name: c.UserDomainName}
+		}
+	}
+
+	req := &keystoneV3TokensRequest{}
+	identity := &req.Auth.Identity
+
+	if c.ApplicationCredentialId != "" || c.ApplicationCredentialName != "" {
+		if c.ApplicationCredentialSecret == "" {
+			return nil, errors.New("applicationCredentialSecret needs to be set in tls.token_providers.keystone_v3 config")
+		}
+		if c.ApplicationCredentialId == "" && user == nil {
+			return nil, errors.New("userId or username needs to be set along with applicationCredentialName")
+		}
+		if c.ProjectId != "" || c.ProjectName != "" || c.DomainId != "" || c.DomainName != "" {
+			return nil, errors.New("application credentials can't be combined with a project or domain scope")
+		}
+
+		identity.Methods = []string{"application_credential"}
+		identity.ApplicationCredential = &keystoneV3ApplicationCredential{
+			Id:     c.ApplicationCredentialId,
+			Name:   c.ApplicationCredentialName,
+			Secret: c.ApplicationCredentialSecret,
+		}
+		if c.ApplicationCredentialId == "" {
+			identity.ApplicationCredential.User = user
+		}
+		return req, nil
+	}
+
+	if user == nil || c.Password == "" {
+		return nil, errors.New("userId or username, and password need to be set in tls.token_providers.keystone_v3 config")
+	}
+	user.Password = c.Password
+	identity.Methods = []string{"password"}
+	identity.Password = &struct {
+		User *keystoneV3User `json:"user"`
+	}{User: user}
+
+	switch {
+	case c.ProjectId != "" || c.ProjectName != "":
+		project := &keystoneV3Project{Id: c.ProjectId, Name: c.ProjectName}
+		if c.ProjectId == "" {
+			if c.ProjectDomainId == "" && c.ProjectDomainName == "" {
+				return nil, errors.New("projectDomainId or projectDomainName needs to be set along with projectName")
+			}
+			project.Domain = &keystoneV3Domain{Id: c.ProjectDomainId, Name: c.ProjectDomainName}
+		}
+		req.Auth.Scope = &keystoneV3Scope{Project: project}
+
+	case c.DomainId != "" || c.DomainName != "":
+		req.Auth.Scope = &keystoneV3Scope{
+			Domain: &keystoneV3Domain{Id: c.DomainId, Name: c.DomainName},
+		}
+	}
+
+	return req, nil
+}
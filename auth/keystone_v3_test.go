@@ -0,0 +1,207 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/oliveagle/jsonpath"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// startKeystoneV3 stands in for a Keystone v3 identity service that passes each tokens request
+// to verify and issues the token, if any
+func startKeystoneV3(t *testing.T, token string, verify func(req interface{})) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/v3/auth/tokens", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+
+		reqBytes, err := ioutil.ReadAll(req.Body)
+		require.NoError(t, err)
+		var reqContent interface{}
+		require.NoError(t, json.Unmarshal(reqBytes, &reqContent))
+		verify(reqContent)
+
+		if token == "" {
+			resp.WriteHeader(401)
+			return
+		}
+		resp.Header().Set("X-Subject-Token", token)
+		resp.Header().Set("Content-Type", "application/json")
+		resp.WriteHeader(201)
+		resp.Write([]byte(`{"token":{}}`))
+	}))
+}
+
+func assertJsonPath(t *testing.T, content interface{}, path string, expected interface{}) {
+	actual, err := jsonpath.JsonPathLookup(content, path)
+	require.NoError(t, err, path)
+	assert.Equal(t, expected, actual, path)
+}
+
+func readKeystoneV3Config(t *testing.T, config string) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(config))
+	require.NoError(t, err)
+}
+
+func TestKeystoneV3AuthTokenProvider_ProvideAuthToken_Password(t *testing.T) {
+	ts := startKeystoneV3(t, "token-v3", func(req interface{}) {
+		assertJsonPath(t, req, "$.auth.identity.methods[0]", "password")
+		assertJsonPath(t, req, "$.auth.identity.password.user.name", "user1")
+		assertJsonPath(t, req, "$.auth.identity.password.user.domain.name", "Default")
+		assertJsonPath(t, req, "$.auth.identity.password.user.password", "secret1")
+		assertJsonPath(t, req, "$.auth.scope.project.name", "monitoring")
+		assertJsonPath(t, req, "$.auth.scope.project.domain.id", "default")
+	})
+	defer ts.Close()
+
+	readKeystoneV3Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    keystone_v3:
+      identityServiceUrl: %s/v3/
+      username: user1
+      userDomainName: Default
+      password: secret1
+      projectName: monitoring
+      projectDomainId: default
+`, ts.URL))
+
+	authTokenProvider, err := auth.NewKeystoneV3AuthTokenProvider()
+	require.NoError(t, err)
+
+	token, err := authTokenProvider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-v3", token.Headers["X-Auth-Token"])
+}
+
+func TestKeystoneV3AuthTokenProvider_ProvideAuthToken_DomainScope(t *testing.T) {
+	ts := startKeystoneV3(t, "token-v3", func(req interface{}) {
+		assertJsonPath(t, req, "$.auth.identity.password.user.id", "user-id-1")
+		assertJsonPath(t, req, "$.auth.scope.domain.name", "Monitoring")
+	})
+	defer ts.Close()
+
+	readKeystoneV3Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    keystone_v3:
+      identityServiceUrl: %s/v3/
+      userId: user-id-1
+      password: secret1
+      domainName: Monitoring
+`, ts.URL))
+
+	authTokenProvider, err := auth.NewKeystoneV3AuthTokenProvider()
+	require.NoError(t, err)
+
+	_, err = authTokenProvider.ProvideAuthToken()
+	require.NoError(t, err)
+}
+
+func TestKeystoneV3AuthTokenProvider_ProvideAuthToken_ApplicationCredential(t *testing.T) {
+	ts := startKeystoneV3(t, "token-v3", func(req interface{}) {
+		assertJsonPath(t, req, "$.auth.identity.methods[0]", "application_credential")
+		assertJsonPath(t, req, "$.auth.identity.application_credential.id", "app-cred-1")
+		assertJsonPath(t, req, "$.auth.identity.application_credential.secret", "app-secret")
+		_, err := jsonpath.JsonPathLookup(req, "$.auth.scope")
+		assert.Error(t, err, "application credentials should not be scoped")
+	})
+	defer ts.Close()
+
+	readKeystoneV3Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    keystone_v3:
+      identityServiceUrl: %s/v3/
+      applicationCredentialId: app-cred-1
+      applicationCredentialSecret: app-secret
+`, ts.URL))
+
+	authTokenProvider, err := auth.NewKeystoneV3AuthTokenProvider()
+	require.NoError(t, err)
+
+	token, err := authTokenProvider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "token-v3", token.Headers["X-Auth-Token"])
+}
+
+func TestKeystoneV3AuthTokenProvider_ProvideAuthToken_BadLogin(t *testing.T) {
+	ts := startKeystoneV3(t, "", func(req interface{}) {})
+	defer ts.Close()
+
+	readKeystoneV3Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    keystone_v3:
+      identityServiceUrl: %s/v3/
+      username: user1
+      userDomainId: default
+      password: wrong
+`, ts.URL))
+
+	authTokenProvider, err := auth.NewKeystoneV3AuthTokenProvider()
+	require.NoError(t, err)
+
+	_, err = authTokenProvider.ProvideAuthToken()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "401")
+}
+
+func TestKeystoneV3AuthTokenProvider_ProvideAuthToken_InvalidConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"no credentials", `identityServiceUrl: http://localhost/v3/`},
+		{"username without domain", `
+      identityServiceUrl: http://localhost/v3/
+      username: user1
+      password: secret1`},
+		{"scoped application credential", `
+      identityServiceUrl: http://localhost/v3/
+      applicationCredentialId: app-cred-1
+      applicationCredentialSecret: app-secret
+      projectId: project-1`},
+		{"application credential name without user", `
+      identityServiceUrl: http://localhost/v3/
+      applicationCredentialName: envoy
+      applicationCredentialSecret: app-secret`},
+	}
+	for _, tt := range tests {
+		readKeystoneV3Config(t, `
+tls:
+  token_providers:
+    keystone_v3:
+      `+strings.TrimSpace(tt.config)+"\n")
+
+		authTokenProvider, err := auth.NewKeystoneV3AuthTokenProvider()
+		require.NoError(t, err)
+
+		_, err = authTokenProvider.ProvideAuthToken()
+		assert.Error(t, err, tt.name)
+	}
+}
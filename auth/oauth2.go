@@ -0,0 +1,198 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oauth2ConfigKey = "tls.token_providers.oauth2"
+
+	// OAuth2AuthStyleHeader sends the client credentials with HTTP basic authentication
+	OAuth2AuthStyleHeader = "header"
+	// OAuth2AuthStyleParams sends the client credentials as form parameters of the token request
+	OAuth2AuthStyleParams = "params"
+)
+
+// OAuth2AuthTokenProvider obtains an access token using the OAuth2 client credentials grant
+type OAuth2AuthTokenProvider struct {
+	authTokenCache
+	authHttpClient
+	config *OAuth2Config
+}
+
+// OAuth2Config is populated from the viper config key "tls.token_providers.oauth2"
+type OAuth2Config struct {
+	TokenUrl     string
+	ClientId     string
+	ClientSecret string
+	// ClientSecretFile is read for the client secret when ClientSecret is not set
+	ClientSecretFile string
+	Scopes           []string
+	Audience         string
+	// EndpointParams are additional form parameters of the token request
+	EndpointParams map[string]string
+	// AuthStyle is either OAuth2AuthStyleHeader, the default, or OAuth2AuthStyleParams
+	AuthStyle string
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+func init() {
+	viper.SetDefault(oauth2ConfigKey+".authStyle", OAuth2AuthStyleHeader)
+
+	err := viper.BindEnv(oauth2ConfigKey+".clientSecret", "ENVOY_OAUTH2_CLIENT_SECRET")
+	if err != nil {
+		log.WithError(err).Fatal("failed to bind OAUTH2_CLIENT_SECRET")
+	}
+
+	RegisterAuthTokenProvider("oauth2", func() (AuthTokenProvider, error) {
+		return NewOAuth2AuthTokenProvider()
+	})
+}
+
+func NewOAuth2AuthTokenProvider() (*OAuth2AuthTokenProvider, error) {
+	return &OAuth2AuthTokenProvider{
+		config: &OAuth2Config{
+			TokenUrl:         viper.GetString(oauth2ConfigKey + ".tokenUrl"),
+			ClientId:         viper.GetString(oauth2ConfigKey + ".clientId"),
+			ClientSecret:     viper.GetString(oauth2ConfigKey + ".clientSecret"),
+			ClientSecretFile: viper.GetString(oauth2ConfigKey + ".clientSecretFile"),
+			Scopes:           viper.GetStringSlice(oauth2ConfigKey + ".scopes"),
+			Audience:         viper.GetString(oauth2ConfigKey + ".audience"),
+			EndpointParams:   viper.GetStringMapString(oauth2ConfigKey + ".endpointParams"),
+			AuthStyle:        viper.GetString(oauth2ConfigKey + ".authStyle"),
+		},
+	}, nil
+}
+
+// ProvideAuthToken reuses the previous access token until it is about to expire
+func (p *OAuth2AuthTokenProvider) ProvideAuthToken() (*AuthToken, error) {
+	return p.get(p.requestAuthToken)
+}
+
+func (p *OAuth2AuthTokenProvider) requestAuthToken() (*AuthToken, error) {
+	if p.config.TokenUrl == "" || p.config.ClientId == "" {
+		return nil, errors.New("tokenUrl and clientId need to be set in tls.token_providers.oauth2 config")
+	}
+
+	clientSecret, err := p.clientSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	for name, value := range p.config.EndpointParams {
+		form.Set(name, value)
+	}
+	form.Set("grant_type", "client_credentials")
+	if len(p.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(p.config.Scopes, " "))
+	}
+	if p.config.Audience != "" {
+		form.Set("audience", p.config.Audience)
+	}
+
+	switch p.config.AuthStyle {
+	case OAuth2AuthStyleHeader, "":
+	case OAuth2AuthStyleParams:
+		form.Set("client_id", p.config.ClientId)
+		form.Set("client_secret", clientSecret)
+	default:
+		return nil, errors.Errorf("unsupported oauth2 authStyle: %s", p.config.AuthStyle)
+	}
+
+	request, err := http.NewRequest("POST", p.config.TokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to prepare token request")
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if p.config.AuthStyle != OAuth2AuthStyleParams {
+		// per RFC 6749 section 2.3.1, the credentials are form encoded prior to basic authentication
+		request.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(clientSecret))
+	}
+
+	log.WithField("url", p.config.TokenUrl).Debug("acquiring oauth2 access token")
+	requested := time.Now()
+
+	client, err := p.httpClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create token endpoint client")
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to post request for token")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Errorf("oauth2 token request failed: %s", resp.Status)
+	}
+
+	var tokenResp oauth2TokenResponse
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode token response")
+	}
+	if tokenResp.AccessToken == "" {
+		return nil, errors.New("oauth2 token response is missing access_token")
+	}
+	if tokenResp.TokenType != "" && !strings.EqualFold(tokenResp.TokenType, "bearer") {
+		return nil, errors.Errorf("unsupported oauth2 token type: %s", tokenResp.TokenType)
+	}
+
+	expires := time.Time{}
+	if tokenResp.ExpiresIn > 0 {
+		expires = requested.Add(time.Duration(tokenResp.ExpiresIn) * time.Second)
+	}
+
+	log.WithField("expires", expires).Debug("acquired oauth2 access token")
+	return &AuthToken{
+		Headers: map[string]string{"Authorization": "Bearer " + tokenResp.AccessToken},
+		Expires: expires,
+	}, nil
+}
+
+// clientSecret is read from the secret file each time, in case the secret was rotated
+func (p *OAuth2AuthTokenProvider) clientSecret() (string, error) {
+	if p.config.ClientSecret != "" {
+		return p.config.ClientSecret, nil
+	}
+	if p.config.ClientSecretFile == "" {
+		return "", errors.New("clientSecret or clientSecretFile needs to be set in tls.token_providers.oauth2 config")
+	}
+
+	content, err := ioutil.ReadFile(p.config.ClientSecretFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to read oauth2 client secret file")
+	}
+	return strings.TrimSpace(string(content)), nil
+}
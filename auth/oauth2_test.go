@@ -0,0 +1,153 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package auth_test
+
+import (
+	"fmt"
+	"github.com/racker/telemetry-envoy/auth"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// startOAuth2TokenEndpoint stands in for an OAuth2 token endpoint that passes each token request
+// to verify and responds with the given body
+func startOAuth2TokenEndpoint(t *testing.T, body string, verify func(req *http.Request)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "POST", req.Method)
+		assert.Equal(t, "/oauth/token", req.URL.Path)
+		require.NoError(t, req.ParseForm())
+		assert.Equal(t, "client_credentials", req.PostForm.Get("grant_type"))
+		verify(req)
+
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write([]byte(body))
+	}))
+}
+
+func readOAuth2Config(t *testing.T, config string) {
+	viper.SetConfigType("yaml")
+	err := viper.ReadConfig(strings.NewReader(config))
+	require.NoError(t, err)
+}
+
+func TestOAuth2AuthTokenProvider_ProvideAuthToken_Normal(t *testing.T) {
+	ts := startOAuth2TokenEndpoint(t, `{"access_token":"access-1","token_type":"Bearer","expires_in":3600}`,
+		func(req *http.Request) {
+			clientId, clientSecret, ok := req.BasicAuth()
+			assert.True(t, ok)
+			assert.Equal(t, "envoy", clientId)
+			assert.Equal(t, "secret%2F1", clientSecret)
+			assert.Equal(t, "telemetry envoy.attach", req.PostForm.Get("scope"))
+			assert.Equal(t, "https://salus.example.com", req.PostForm.Get("audience"))
+			assert.Equal(t, "salus", req.PostForm.Get("resource"))
+			assert.Empty(t, req.PostForm.Get("client_secret"))
+		})
+	defer ts.Close()
+
+	readOAuth2Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    oauth2:
+      tokenUrl: %s/oauth/token
+      clientId: envoy
+      clientSecret: secret/1
+      scopes:
+        - telemetry
+        - envoy.attach
+      audience: https://salus.example.com
+      endpointParams:
+        resource: salus
+`, ts.URL))
+
+	authTokenProvider, err := auth.NewOAuth2AuthTokenProvider()
+	require.NoError(t, err)
+
+	token, err := authTokenProvider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer access-1", token.Headers["Authorization"])
+}
+
+func TestOAuth2AuthTokenProvider_ProvideAuthToken_SecretFileAsParams(t *testing.T) {
+	secretFile, err := ioutil.TempFile("", "oauth2_secret")
+	require.NoError(t, err)
+	defer os.Remove(secretFile.Name())
+	_, err = secretFile.WriteString("file-secret\n")
+	require.NoError(t, err)
+	secretFile.Close()
+
+	ts := startOAuth2TokenEndpoint(t, `{"access_token":"access-2"}`, func(req *http.Request) {
+		_, _, ok := req.BasicAuth()
+		assert.False(t, ok)
+		assert.Equal(t, "envoy", req.PostForm.Get("client_id"))
+		assert.Equal(t, "file-secret", req.PostForm.Get("client_secret"))
+	})
+	defer ts.Close()
+
+	readOAuth2Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    oauth2:
+      tokenUrl: %s/oauth/token
+      clientId: envoy
+      clientSecretFile: %s
+      authStyle: params
+`, ts.URL, secretFile.Name()))
+
+	authTokenProvider, err := auth.NewOAuth2AuthTokenProvider()
+	require.NoError(t, err)
+
+	token, err := authTokenProvider.ProvideAuthToken()
+	require.NoError(t, err)
+	assert.Equal(t, "Bearer access-2", token.Headers["Authorization"])
+}
+
+func TestOAuth2AuthTokenProvider_ProvideAuthToken_Failures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if _, secret, _ := req.BasicAuth(); secret != "secret-1" {
+			resp.WriteHeader(401)
+			resp.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		resp.Header().Set("Content-Type", "application/json")
+		resp.Write([]byte(`{"access_token":"access-1","token_type":"mac"}`))
+	}))
+	defer ts.Close()
+
+	for _, clientSecret := range []string{"wrong", "secret-1"} {
+		readOAuth2Config(t, fmt.Sprintf(`
+tls:
+  token_providers:
+    oauth2:
+      tokenUrl: %s/oauth/token
+      clientId: envoy
+      clientSecret: %s
+`, ts.URL, clientSecret))
+
+		authTokenProvider, err := auth.NewOAuth2AuthTokenProvider()
+		require.NoError(t, err)
+
+		_, err = authTokenProvider.ProvideAuthToken()
+		assert.Error(t, err, clientSecret)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/racker/telemetry-envoy/agents"
+	"github.com/racker/telemetry-envoy/config"
+	"github.com/racker/telemetry-envoy/telemetry_edge"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"strings"
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback AGENT_TYPE [VERSION]",
+	Short: "Point an agent back at a previously installed version",
+	Long: `Point an agent back at a previously installed version. When the version is not given,
+the version installed prior to the current one is used.
+
+The agent process of a running Envoy needs to be restarted to pick up the change, such as by
+restarting the Envoy.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		agentType, ok := telemetry_edge.AgentType_value[strings.ToUpper(args[0])]
+		if !ok {
+			log.WithField("type", args[0]).Fatal("unknown agent type")
+		}
+
+		version := ""
+		if len(args) > 1 {
+			version = args[1]
+		}
+
+		current, err := agents.RollbackAgent(viper.GetString(config.AgentsDataPath),
+			telemetry_edge.AgentType(agentType), version)
+		if err != nil {
+			log.WithError(err).Fatal("failed to roll back agent")
+		}
+
+		fmt.Printf("%s is now at version %s\n", telemetry_edge.AgentType(agentType), current)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rollbackCmd)
+
+	addDataPathFlag(rollbackCmd)
+}
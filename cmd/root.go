@@ -21,6 +21,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/mitchellh/go-homedir"
+	"github.com/racker/telemetry-envoy/config"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -57,6 +58,16 @@ func init() {
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Enable debug output")
 }
 
+// addDataPathFlag adds the data-path flag to a command. Since several commands share the flag,
+// it is bound to the config key only once the command is chosen to run.
+func addDataPathFlag(cmd *cobra.Command) {
+	cmd.Flags().String("data-path", config.DefaultAgentsDataPath,
+		"Data directory where Envoy stores downloaded agents and write agent configs")
+	cmd.PreRun = func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag(config.AgentsDataPath, cmd.Flag("data-path"))
+	}
+}
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	// Configure logging thresholds
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/racker/telemetry-envoy/ambassador"
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var rotateIdCmd = &cobra.Command{
+	Use:   "rotate-id",
+	Short: "Replace the identity the Envoy presents to the Ambassador",
+	Long: `Replace the identity the Envoy presents to the Ambassador with a newly generated one.
+
+The identity is otherwise retained across reconnects and restarts. A running Envoy uses the new
+identity the next time it attaches to the Ambassador.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := ambassador.RotateEnvoyId(viper.GetString(config.AgentsDataPath))
+		if err != nil {
+			log.WithError(err).Fatal("failed to rotate Envoy identity")
+		}
+
+		fmt.Printf("Envoy identity is now %s\n", id)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rotateIdCmd)
+
+	addDataPathFlag(rotateIdCmd)
+}
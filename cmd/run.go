@@ -45,6 +45,7 @@ var runCmd = &cobra.Command{
 			if err != nil {
 				log.WithError(err).Fatal("unable to setup ambassador connection")
 			}
+			agents.SetEventPoster(connection)
 
 			for _, ingestor := range ingest.Ingestors() {
 				err := ingestor.Bind(connection)
@@ -98,7 +99,5 @@ func init() {
 	runCmd.Flags().String("resource-id", "", "Identifier of the resource where this Envoy is running")
 	viper.BindPFlag(config.ResourceId, runCmd.Flag("resource-id"))
 
-	runCmd.Flags().String("data-path", config.DefaultAgentsDataPath,
-		"Data directory where Envoy stores downloaded agents and write agent configs")
-	viper.BindPFlag(config.AgentsDataPath, runCmd.Flag("data-path"))
+	addDataPathFlag(runCmd)
 }
@@ -21,9 +21,32 @@ const (
 	AgentsDataPath                 = "agents.dataPath"
 	AgentsTerminationTimeoutConfig = "agents.terminationTimeout"
 	AgentsRestartDelayConfig       = "agents.restartDelay"
+	AgentsMaxRestartDelay          = "agents.maxRestartDelay"
+	AgentsStableUptime             = "agents.stableUptime"
+	AgentsCrashLoopThreshold       = "agents.crashLoop.threshold"
+	AgentsCrashLoopWindow          = "agents.crashLoop.window"
+	AgentsEventOutputLines         = "agents.eventOutputLines"
+	AgentsExtractModesConfig       = "agents.extractModes"
+	AgentsRetainVersions           = "agents.retainVersions"
+	AgentsUpgradeGracePeriod       = "agents.upgradeGracePeriod"
+	AgentsDownloadProxy            = "agents.download.proxy"
+	AgentsDownloadCaFile           = "agents.download.caFile"
+	AgentsDownloadConnectTimeout   = "agents.download.connectTimeout"
+	AgentsDownloadTimeout          = "agents.download.timeout"
+	AgentsDownloadRetries          = "agents.download.retries"
+	AgentsDownloadRetryDelay       = "agents.download.retryDelay"
 	IngestLumberjackBind           = "ingest.lumberjack.bind"
 	IngestTelegrafJsonBind         = "ingest.telegraf.json.bind"
 	AmbassadorAddress              = "ambassador.address"
+	AmbassadorAddresses            = "ambassador.addresses"
+	AmbassadorSrv                  = "ambassador.srv"
+	AmbassadorFailbackAfter        = "ambassador.failbackAfter"
+	AmbassadorProxyUrl             = "ambassador.proxy.url"
+	AmbassadorProxyUsername        = "ambassador.proxy.username"
+	AmbassadorProxyPassword        = "ambassador.proxy.password"
+	AmbassadorProxyNoProxy         = "ambassador.proxy.noProxy"
+	TlsRenewalLifetimeFraction     = "tls.renewal.lifetimeFraction"
+	TlsRenewalRetryDelay           = "tls.renewal.retryDelay"
 	ResourceId                     = "resource_id"
 	Zone                           = "zone"
 
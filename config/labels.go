@@ -43,6 +43,8 @@ var (
 	OsLabel          = DiscoveredLabel("os")
 	SerialNoLabel    = DiscoveredLabel("serial")
 	XenIdLabel       = DiscoveredLabel("xen_id")
+	// AmbassadorEndpointLabel conveys the Ambassador endpoint that the Envoy is attached to
+	AmbassadorEndpointLabel = DiscoveredLabel("ambassador_endpoint")
 )
 
 // ComputeLabels reads any labels specified in the config file.
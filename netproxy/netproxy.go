@@ -0,0 +1,295 @@
+/*
+ * Copyright 2019 Rackspace US, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package netproxy provides outbound connections through an explicitly configured HTTP CONNECT
+// or SOCKS5 proxy, such as for networks that only allow outbound traffic through a proxy.
+package netproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/pkg/errors"
+	"github.com/racker/telemetry-envoy/config"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	err := viper.BindEnv(config.AmbassadorProxyPassword, "ENVOY_PROXY_PASSWORD")
+	if err != nil {
+		log.WithError(err).Fatal("failed to bind proxy password env variable")
+	}
+}
+
+// Config declares the proxy to use for outbound connections
+type Config struct {
+	// Url of the proxy, with a scheme of http, https, or socks5. Credentials can be included
+	// in the URL or provided by Username and Password.
+	Url      *url.URL
+	Username string
+	Password string
+	// NoProxy is a comma separated list of hosts, domain suffixes, IP addresses, and CIDR networks
+	// that are connected to directly. A value of * disables the proxy. When not configured, it is
+	// taken from the NO_PROXY or no_proxy env variable.
+	NoProxy string
+}
+
+// LoadConfig reads the proxy configuration from the ambassador.proxy keys, which is shared by
+// the Ambassador connection and the auth service client. It returns nil when no proxy is configured.
+func LoadConfig() (*Config, error) {
+	rawUrl := viper.GetString(config.AmbassadorProxyUrl)
+	if rawUrl == "" {
+		return nil, nil
+	}
+
+	proxyUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid proxy url: %s", rawUrl)
+	}
+	switch proxyUrl.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, errors.Errorf("unsupported proxy scheme: %s", proxyUrl.Scheme)
+	}
+	if proxyUrl.Port() == "" {
+		return nil, errors.Errorf("proxy url is missing a port: %s", rawUrl)
+	}
+
+	proxyConfig := &Config{
+		Url:      proxyUrl,
+		Username: viper.GetString(config.AmbassadorProxyUsername),
+		Password: viper.GetString(config.AmbassadorProxyPassword),
+		NoProxy:  viper.GetString(config.AmbassadorProxyNoProxy),
+	}
+	if proxyConfig.NoProxy == "" {
+		proxyConfig.NoProxy = noProxyFromEnv()
+	}
+	if proxyConfig.Username == "" && proxyUrl.User != nil {
+		proxyConfig.Username = proxyUrl.User.Username()
+		proxyConfig.Password, _ = proxyUrl.User.Password()
+	}
+
+	return proxyConfig, nil
+}
+
+// noProxyFromEnv returns the standard NO_PROXY env variable or its lowercase form
+func noProxyFromEnv() string {
+	if noProxy := os.Getenv("NO_PROXY"); noProxy != "" {
+		return noProxy
+	}
+	return os.Getenv("no_proxy")
+}
+
+// Bypass indicates if the given host, optionally with a port, is excluded from the proxy by NoProxy
+func (c *Config) Bypass(address string) bool {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(c.NoProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		if entryIp := net.ParseIP(entry); entryIp != nil {
+			if ip != nil && entryIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		// a domain matches itself and its subdomains, with or without a leading dot
+		entry = strings.TrimPrefix(entry, ".")
+		if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// DialContext connects to the given TCP address through the proxy, unless the address is
+// excluded by NoProxy
+func (c *Config) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	if c.Bypass(address) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	log.WithFields(log.Fields{
+		"proxy":   c.Url.Host,
+		"address": address,
+	}).Debug("connecting through proxy")
+
+	if c.Url.Scheme == "socks5" {
+		return c.dialSocks5(ctx, network, address)
+	}
+	return c.dialHttpConnect(ctx, network, address)
+}
+
+// GrpcDialer adapts DialContext for use with grpc.WithDialer
+func (c *Config) GrpcDialer(address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.DialContext(ctx, "tcp", address)
+}
+
+// HttpProxy can be used as the Proxy of an http.Transport, which will then use the proxy
+// for requests to hosts not excluded by NoProxy
+func (c *Config) HttpProxy(req *http.Request) (*url.URL, error) {
+	if c.Bypass(req.URL.Host) {
+		return nil, nil
+	}
+
+	proxyUrl := *c.Url
+	if c.Username != "" {
+		proxyUrl.User = url.UserPassword(c.Username, c.Password)
+	}
+	return &proxyUrl, nil
+}
+
+// contextDialer is implemented by the SOCKS5 dialer of the proxy package, which predates
+// the proxy.ContextDialer interface
+type contextDialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+func (c *Config) dialSocks5(ctx context.Context, network string, address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if c.Username != "" {
+		auth = &proxy.Auth{User: c.Username, Password: c.Password}
+	}
+
+	dialer, err := proxy.SOCKS5("tcp", c.Url.Host, auth, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to setup SOCKS5 proxy dialer")
+	}
+
+	var conn net.Conn
+	if withContext, ok := dialer.(contextDialer); ok {
+		conn, err = withContext.DialContext(ctx, network, address)
+	} else {
+		// the dialer is unable to honor the context, so at least don't start once it's done
+		if err = ctx.Err(); err == nil {
+			conn, err = dialer.Dial(network, address)
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to %s via SOCKS5 proxy", address)
+	}
+	return conn, nil
+}
+
+func (c *Config) dialHttpConnect(ctx context.Context, network string, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, c.Url.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to proxy")
+	}
+
+	if c.Url.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: c.Url.Hostname()})
+	}
+
+	// the proxy handshake is bounded by the context, such as a dial timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	stopWatching := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stopWatching:
+		}
+	}()
+	defer func() {
+		close(stopWatching)
+		<-watchDone
+		// the deadline is cleared once the watcher can no longer set it
+		_ = conn.SetDeadline(time.Time{})
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if c.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(c.Username + ":" + c.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to send CONNECT request to proxy")
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "failed to read CONNECT response from proxy")
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	if reader.Buffered() > 0 {
+		// retain anything the proxy sent beyond its response
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}